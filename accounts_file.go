@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+accountsUpdate is sent to the FileAccountStore service to change the accounts. The function is
+applied to a copy of the accounts and the result is only kept if the accounts file was written
+successfully.
+*/
+type accountsUpdate struct {
+	fn  func(accts map[string]*Account) error
+	res chan error
+}
+
+/*
+FileAccountStore is the default AccountStore. It keeps the accounts from the accounts file in
+memory and is ran as a service so the accounts can be reloaded while requests are handled.
+*/
+type FileAccountStore struct {
+	path      string
+	accts     map[string]*Account
+	acctTime  time.Time
+	chanReq   chan string
+	chanRes   chan *Account
+	chanList  chan chan []Account
+	chanWrite chan accountsUpdate
+}
+
+//NewFileAccountStore creates a new FileAccountStore for the accounts file at path.
+func NewFileAccountStore(path string) *FileAccountStore {
+	return &FileAccountStore{
+		path:      path,
+		accts:     make(map[string]*Account),
+		chanReq:   make(chan string),
+		chanRes:   make(chan *Account),
+		chanList:  make(chan chan []Account),
+		chanWrite: make(chan accountsUpdate),
+	}
+}
+
+/*
+Get returns a copy of the account from the service.
+*/
+func (a *FileAccountStore) Get(username string) (*Account, error) {
+	a.chanReq <- username
+	if acct := <-a.chanRes; acct != nil {
+		return acct, nil
+	}
+	return nil, errAccountNotFound
+}
+
+/*
+List returns a copy of all the accounts sorted by username.
+*/
+func (a *FileAccountStore) List() ([]Account, error) {
+	res := make(chan []Account)
+	a.chanList <- res
+	return <-res, nil
+}
+
+/*
+Create adds the account to the accounts file.
+*/
+func (a *FileAccountStore) Create(acct *Account) error {
+	cp := *acct
+	return a.update(func(accts map[string]*Account) error {
+		if _, exists := accts[cp.Username]; exists {
+			return errAccountExists
+		}
+		accts[cp.Username] = &cp
+		return nil
+	})
+}
+
+/*
+Update changes an account in the accounts file.
+*/
+func (a *FileAccountStore) Update(username string, fn func(acct *Account) error) error {
+	return a.update(func(accts map[string]*Account) error {
+		acct, exists := accts[username]
+		if !exists {
+			return errAccountNotFound
+		}
+		return fn(acct)
+	})
+}
+
+/*
+Delete removes an account from the accounts file.
+*/
+func (a *FileAccountStore) Delete(username string) error {
+	return a.update(func(accts map[string]*Account) error {
+		if _, exists := accts[username]; !exists {
+			return errAccountNotFound
+		}
+		delete(accts, username)
+		return nil
+	})
+}
+
+/*
+update applies fn to the accounts, writes the result to the accounts file and makes it live
+immediately. If fn or writing the file fails the accounts are left unchanged.
+*/
+func (a *FileAccountStore) update(fn func(accts map[string]*Account) error) error {
+	res := make(chan error)
+	a.chanWrite <- accountsUpdate{fn: fn, res: res}
+	return <-res
+}
+
+/*
+AccountsService is ran in a separate go rountine and handles the lookups and changes of accounts.
+The accounts file is reloaded when it changes on disk, when the process receives SIGHUP and on the
+checkAccount interval as a fallback.
+*/
+func (a *FileAccountStore) AccountsService() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	changed, err := watchFile(a.path)
+	if err != nil {
+		log.Printf("failed to watch accounts file, falling back to checking every %v, %v", accountCheck, err)
+	}
+
+	a.reload(true)
+	check := time.After(accountCheck)
+	for {
+		select {
+		case <-check: //Check the accounts file.
+			a.reload(false)
+			check = time.After(accountCheck)
+
+		case <-changed: //The accounts file changed on disk
+			a.reload(false)
+
+		case <-hup: //Reload requested by the administrator
+			log.Println("reloading accounts file on SIGHUP")
+			a.reload(true)
+
+		case username := <-a.chanReq: //Look up an account
+			if acct, ok := a.accts[username]; ok {
+				cp := *acct
+				a.chanRes <- &cp
+			} else {
+				a.chanRes <- nil
+			}
+
+		case res := <-a.chanList: //List the accounts
+			list := make([]Account, 0, len(a.accts))
+			for _, acct := range a.accts {
+				list = append(list, *acct)
+			}
+			sort.Sort(accountsByName(list))
+			res <- list
+
+		case req := <-a.chanWrite: //Change the accounts
+			accts := make(map[string]*Account, len(a.accts))
+			for k, v := range a.accts {
+				cp := *v
+				accts[k] = &cp
+			}
+			if err := req.fn(accts); err != nil {
+				req.res <- err
+				continue
+			}
+			lastMod, err := writeAccountsFile(a.path, accts)
+			if err != nil {
+				req.res <- err
+				continue
+			}
+			a.accts = accts
+			a.acctTime = lastMod
+			req.res <- nil
+		}
+	}
+}
+
+/*
+reload reads the accounts file if it was modified since it was last read, or always when force is
+set. If the file cannot be read or has errors the accounts currently loaded are kept and the errors
+are logged once, the file is not read again until it changes. The only exception is when no
+accounts have been loaded yet, then the valid lines are used so the server can still be used while
+the file is fixed.
+*/
+func (a *FileAccountStore) reload(force bool) {
+	stat, err := os.Stat(a.path)
+	if err != nil {
+		log.Printf("failed to stat accounts file, keeping the %v loaded accounts, %v", len(a.accts), err)
+		return
+	}
+	lastMod := stat.ModTime()
+	if !force && lastMod.Equal(a.acctTime) {
+		return
+	}
+	a.acctTime = lastMod
+
+	accts, err := parseAccountsFile(a.path)
+	if err != nil {
+		if _, ok := err.(AccountsFileErrors); !ok || len(a.accts) > 0 {
+			log.Printf("error parsing accounts file, keeping the %v loaded accounts, %v", len(a.accts), err)
+			return
+		}
+		log.Printf("error parsing accounts file, loading the valid lines as no accounts are loaded, %v", err)
+	}
+	warnPlainTextPasswords(accts, a.accts)
+	a.accts = accts
+	log.Printf("loaded %v accounts", len(accts))
+}
+
+/*
+warnPlainTextPasswords logs a warning for each account with a plain text password, except those
+whose password is the same as in the previously loaded accounts so they are only warned about once.
+*/
+func warnPlainTextPasswords(accts, previous map[string]*Account) {
+	for username, acct := range accts {
+		if isHashedPassword(acct.Password) {
+			continue
+		}
+		if prev, ok := previous[username]; ok && prev.Password == acct.Password {
+			continue
+		}
+		log.Printf("account %v has a plain text password, use hash-password to replace it", username)
+	}
+}
+
+/*
+parseAccountsFile opens the accounts file at path and reads in the credential pairs. The expected format for the file is:
+
+	username:password[:key=value...]
+
+The password may be plain text or a bcrypt or argon2id hash as printed by the hash-password
+command. Plain text passwords are still accepted, the callers warn about them so they can be
+migrated. The optional fields after the password configure the account:
+
+	username:password:role=researcher
+	username:password:disabled=true
+
+Empty lines are skipped. Malformed lines and duplicate usernames are returned as an
+AccountsFileErrors along with the accounts from the valid lines.
+*/
+func parseAccountsFile(path string) (map[string]*Account, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	accts := make(map[string]*Account)
+	lines := make(map[string]int)
+	var errs AccountsFileErrors
+
+	scanner := bufio.NewScanner(f)
+
+	for num := 1; scanner.Scan(); num++ {
+		txt := scanner.Text()
+		if txt == "" {
+			continue
+		}
+		acct, err := parseAccount(txt)
+		if err != nil {
+			errs = append(errs, &AccountsLineError{Line: num, Err: err})
+			continue
+		}
+		if first, exists := lines[acct.Username]; exists {
+			errs = append(errs, &AccountsLineError{Line: num, Err: fmt.Errorf("duplicate account %v, first defined on line %v", acct.Username, first)})
+			continue
+		}
+		accts[acct.Username] = acct
+		lines[acct.Username] = num
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return accts, errs
+	}
+	return accts, nil
+}
+
+/*
+importAccountsCommand implements the import-accounts command. It copies the accounts from an
+accounts file into the configured account store, skipping usernames that already exist.
+
+	activebrain -accountStore sqlite import-accounts [path]
+*/
+func importAccountsCommand(args []string) error {
+	if accountStore == "file" {
+		return errors.New("import-accounts needs -accountStore set to redis or sqlite")
+	}
+	path := accountPath
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	accts, err := parseAccountsFile(path)
+	if err != nil {
+		return err
+	}
+	warnPlainTextPasswords(accts, nil)
+
+	imported := 0
+	for _, acct := range accts {
+		if err := validateUsername(acct.Username); err != nil {
+			log.Printf("skipped account %q, %v", acct.Username, err)
+			continue
+		}
+		if err := accounts.Create(acct); err == errAccountExists {
+			log.Printf("skipped account %v as it already exists", acct.Username)
+			continue
+		} else if err != nil {
+			return err
+		}
+		imported++
+	}
+	log.Printf("imported %v of %v accounts", imported, len(accts))
+	return nil
+}
+
+//AccountsLineError describes a problem with a single line of the accounts file.
+type AccountsLineError struct {
+	Line int
+	Err  error
+}
+
+func (e *AccountsLineError) Error() string {
+	return fmt.Sprintf("line %v: %v", e.Line, e.Err)
+}
+
+//AccountsFileErrors is all the problems found while parsing the accounts file.
+type AccountsFileErrors []*AccountsLineError
+
+func (e AccountsFileErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+/*
+writeAccountsFile replaces the accounts file at path with the provided accounts. The file is written to a
+temporary file in the same folder and renamed over the accounts file so readers never see a partial
+file. Lines that were ignored while parsing are not carried over. The modification time of the new
+file is returned.
+*/
+func writeAccountsFile(path string, accts map[string]*Account) (time.Time, error) {
+	names := make([]string, 0, len(accts))
+	for name := range accts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(formatAccount(accts[name]))
+		buf.WriteByte('\n')
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".accounts")
+	if err != nil {
+		return time.Time{}, err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return time.Time{}, err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return time.Time{}, err
+	}
+	if err = f.Close(); err != nil {
+		return time.Time{}, err
+	}
+	if err = os.Chmod(tmp, 0600); err != nil {
+		return time.Time{}, err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return time.Time{}, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+captureLog returns the buffer the standard logger writes to until the test ends.
+*/
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+//writeAccounts writes the lines to the accounts file with a modification time after the last one.
+func writeAccounts(t *testing.T, path string, mod time.Time, lines ...string) {
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileAccountStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts")
+	mod := time.Now().Add(-time.Hour)
+	writeAccounts(t, path, mod, "alice:secret", "bob:$2a$10$abcdefghijklmnopqrstuu")
+	logs := captureLog(t)
+
+	a := NewFileAccountStore(path)
+	a.reload(true)
+	if len(a.accts) != 2 {
+		t.Fatalf("loaded %v accounts, want 2", len(a.accts))
+	}
+	if n := strings.Count(logs.String(), "plain text password"); n != 1 {
+		t.Errorf("warned about %v plain text passwords, want 1\n%v", n, logs)
+	}
+
+	//A broken file keeps the accounts and is only reported once
+	logs.Reset()
+	writeAccounts(t, path, mod.Add(time.Minute), "alice:secret", "bob:$2a$10$abcdefghijklmnopqrstuu", "broken")
+	for i := 0; i < 3; i++ {
+		a.reload(false)
+	}
+	if n := strings.Count(logs.String(), "error parsing accounts file"); n != 1 {
+		t.Errorf("reported the errors %v times, want 1\n%v", n, logs)
+	}
+	if len(a.accts) != 2 {
+		t.Errorf("kept %v accounts, want 2", len(a.accts))
+	}
+
+	//Only plain text passwords that changed are warned about again
+	logs.Reset()
+	writeAccounts(t, path, mod.Add(2*time.Minute), "alice:secret", "bob:changed", "carol:$2a$10$abcdefghijklmnopqrstuu")
+	a.reload(false)
+	a.reload(false)
+	if len(a.accts) != 3 {
+		t.Fatalf("loaded %v accounts, want 3", len(a.accts))
+	}
+	if strings.Contains(logs.String(), "alice") || strings.Count(logs.String(), "account bob has a plain text") != 1 {
+		t.Errorf("unexpected warnings\n%v", logs)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fzzy/radix/redis"
+)
+
+//redisAccountsSet is the redis set holding the usernames of all the accounts.
+const redisAccountsSet = "accounts:all"
+
+/*
+RedisAccountStore is an AccountStore that keeps each account as a hash in redis using rpool. The
+hash is stored under account:<username> and the usernames are kept in the accounts:all set so
+they can be listed without scanning keys.
+*/
+type RedisAccountStore struct{}
+
+//NewRedisAccountStore creates a new RedisAccountStore.
+func NewRedisAccountStore() *RedisAccountStore {
+	return &RedisAccountStore{}
+}
+
+func redisAccountKey(username string) string {
+	return "account:" + username
+}
+
+/*
+Get fetches the account from redis.
+*/
+func (s *RedisAccountStore) Get(username string) (*Account, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var acct *Account
+	acct, err = redisGetAccount(c, username)
+	return acct, err
+}
+
+/*
+List fetches all the accounts from redis sorted by username.
+*/
+func (s *RedisAccountStore) List() ([]Account, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var names []string
+	if names, err = c.Cmd("SMEMBERS", redisAccountsSet).List(); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		c.Append("HGETALL", redisAccountKey(name))
+	}
+
+	list := make([]Account, 0, len(names))
+	for _, name := range names {
+		var vals map[string]string
+		if vals, err = c.GetReply().Hash(); err != nil {
+			return nil, err
+		}
+		if len(vals) == 0 { //Deleted between SMEMBERS and HGETALL
+			continue
+		}
+		var acct *Account
+		if acct, err = redisAccount(name, vals); err != nil {
+			return nil, err
+		}
+		list = append(list, *acct)
+	}
+	sort.Sort(accountsByName(list))
+	return list, nil
+}
+
+/*
+Create adds the account to redis if the username is not taken.
+*/
+func (s *RedisAccountStore) Create(acct *Account) error {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	key := redisAccountKey(acct.Username)
+	if err = c.Cmd("WATCH", key).Err; err != nil {
+		return err
+	}
+	var exists int
+	if exists, err = c.Cmd("EXISTS", key).Int(); err != nil {
+		c.Cmd("UNWATCH")
+		return err
+	} else if exists == 1 {
+		c.Cmd("UNWATCH")
+		return errAccountExists
+	}
+	err = redisSaveAccount(c, acct, true)
+	return err
+}
+
+/*
+Update changes an account in redis. The account is watched while fn runs so a concurrent change
+makes the update fail with errAccountConflict instead of being overwritten.
+*/
+func (s *RedisAccountStore) Update(username string, fn func(acct *Account) error) error {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	if err = c.Cmd("WATCH", redisAccountKey(username)).Err; err != nil {
+		return err
+	}
+	var acct *Account
+	if acct, err = redisGetAccount(c, username); err != nil {
+		c.Cmd("UNWATCH")
+		return err
+	}
+	if err = fn(acct); err != nil {
+		c.Cmd("UNWATCH")
+		return err
+	}
+	err = redisSaveAccount(c, acct, false)
+	return err
+}
+
+/*
+Delete removes an account from redis.
+*/
+func (s *RedisAccountStore) Delete(username string) error {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var removed int
+	if removed, err = c.Cmd("DEL", redisAccountKey(username)).Int(); err != nil {
+		return err
+	}
+	if err = c.Cmd("SREM", redisAccountsSet, username).Err; err != nil {
+		return err
+	}
+	if removed == 0 {
+		return errAccountNotFound
+	}
+	return nil
+}
+
+/*
+redisGetAccount fetches an account using an existing connection.
+*/
+func redisGetAccount(c *redis.Client, username string) (*Account, error) {
+	vals, err := c.Cmd("HGETALL", redisAccountKey(username)).Hash()
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return nil, errAccountNotFound
+	}
+	return redisAccount(username, vals)
+}
+
+/*
+redisAccount converts the fields of an account hash into an Account.
+*/
+func redisAccount(username string, vals map[string]string) (*Account, error) {
+	role, err := ParseRole(vals["Role"])
+	if err != nil {
+		return nil, err
+	}
+	acct := &Account{
+		Username: username,
+		Password: vals["Password"],
+		Role:     role,
+		Disabled: vals["Disabled"] == "true",
+		Demo:     vals["Demo"] == "true",
+
+		TOTPSecret:    vals["TOTP"],
+		RecoveryCodes: splitList(vals["Recovery"]),
+	}
+	if vals["Tasks"] != "" {
+		if acct.Tasks, err = strconv.Atoi(vals["Tasks"]); err != nil {
+			return nil, err
+		}
+	}
+	if acct.Start, err = parseStoredTime(vals["Start"]); err != nil {
+		return nil, err
+	}
+	if acct.End, err = parseStoredTime(vals["End"]); err != nil {
+		return nil, err
+	}
+	return acct, nil
+}
+
+/*
+redisSaveAccount writes the account hash in a transaction, adding the username to the
+accounts:all set for new accounts. The key must already be watched, errAccountConflict is returned
+if it changed since.
+*/
+func redisSaveAccount(c *redis.Client, acct *Account, isNew bool) error {
+	if err := c.Cmd("MULTI").Err; err != nil {
+		return err
+	}
+	c.Cmd("HMSET", redisAccountKey(acct.Username),
+		"Password", acct.Password,
+		"Role", string(acct.Role),
+		"Disabled", strconv.FormatBool(acct.Disabled),
+		"Demo", strconv.FormatBool(acct.Demo),
+		"Tasks", acct.Tasks,
+		"TOTP", acct.TOTPSecret,
+		"Recovery", strings.Join(acct.RecoveryCodes, ","),
+		"Start", formatStoredTime(acct.Start),
+		"End", formatStoredTime(acct.End))
+	if isNew {
+		c.Cmd("SADD", redisAccountsSet, acct.Username)
+	}
+	rep := c.Cmd("EXEC")
+	if rep.Err != nil {
+		return rep.Err
+	} else if rep.Type == redis.NilReply {
+		return errAccountConflict
+	}
+	return nil
+}
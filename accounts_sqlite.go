@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteAccountsSchema = `CREATE TABLE IF NOT EXISTS accounts (
+	username TEXT PRIMARY KEY,
+	password TEXT NOT NULL,
+	role     TEXT NOT NULL DEFAULT 'participant',
+	disabled INTEGER NOT NULL DEFAULT 0
+)`
+
+/*
+sqliteAccountsColumns are added to the accounts table when missing so databases created by older
+versions keep working.
+*/
+var sqliteAccountsColumns = []struct{ name, def string }{
+	{"starts_at", "TEXT NOT NULL DEFAULT ''"},
+	{"ends_at", "TEXT NOT NULL DEFAULT ''"},
+	{"demo", "INTEGER NOT NULL DEFAULT 0"},
+	{"totp_secret", "TEXT NOT NULL DEFAULT ''"},
+	{"recovery_codes", "TEXT NOT NULL DEFAULT ''"},
+	{"task_quota", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+//sqliteAccountSelect selects all the columns read by scanAccount.
+const sqliteAccountSelect = `SELECT username, password, role, disabled, starts_at, ends_at, demo, totp_secret, recovery_codes, task_quota FROM accounts`
+
+/*
+SQLiteAccountStore is an AccountStore that keeps the accounts in a table of a SQLite database.
+*/
+type SQLiteAccountStore struct {
+	db *sql.DB
+}
+
+/*
+NewSQLiteAccountStore opens the SQLite database at path, creating it and the accounts table if
+needed.
+*/
+func NewSQLiteAccountStore(path string) (*SQLiteAccountStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	//SQLite only allows one writer, a single connection avoids busy errors between requests.
+	db.SetMaxOpenConns(1)
+
+	if err = migrateSQLiteAccounts(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteAccountStore{db: db}, nil
+}
+
+/*
+migrateSQLiteAccounts creates the accounts table and adds any missing columns.
+*/
+func migrateSQLiteAccounts(db *sql.DB) error {
+	if _, err := db.Exec(sqliteAccountsSchema); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`PRAGMA table_info(accounts)`)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, ctype string
+		var def sql.NullString
+		if err = rows.Scan(&cid, &name, &ctype, &notNull, &def, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, col := range sqliteAccountsColumns {
+		if existing[col.name] {
+			continue
+		}
+		if _, err = db.Exec(`ALTER TABLE accounts ADD COLUMN ` + col.name + ` ` + col.def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//sqliteRow is implemented by both *sql.Row and *sql.Rows
+type sqliteRow interface {
+	Scan(dest ...interface{}) error
+}
+
+/*
+scanAccount reads an account from a row selected with sqliteAccountSelect.
+*/
+func scanAccount(row sqliteRow) (*Account, error) {
+	var acct Account
+	var role, start, end, recovery string
+	if err := row.Scan(&acct.Username, &acct.Password, &role, &acct.Disabled, &start, &end, &acct.Demo,
+		&acct.TOTPSecret, &recovery, &acct.Tasks); err == sql.ErrNoRows {
+		return nil, errAccountNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var err error
+	if acct.Role, err = ParseRole(role); err != nil {
+		return nil, err
+	}
+	if acct.Start, err = parseStoredTime(start); err != nil {
+		return nil, err
+	}
+	if acct.End, err = parseStoredTime(end); err != nil {
+		return nil, err
+	}
+	acct.RecoveryCodes = splitList(recovery)
+	return &acct, nil
+}
+
+/*
+Get fetches the account from the database.
+*/
+func (s *SQLiteAccountStore) Get(username string) (*Account, error) {
+	return scanAccount(s.db.QueryRow(sqliteAccountSelect+` WHERE username = ?`, username))
+}
+
+/*
+List fetches all the accounts from the database sorted by username.
+*/
+func (s *SQLiteAccountStore) List() ([]Account, error) {
+	rows, err := s.db.Query(sqliteAccountSelect + ` ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]Account, 0)
+	for rows.Next() {
+		acct, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *acct)
+	}
+	return list, rows.Err()
+}
+
+/*
+Create inserts the account if the username is not taken.
+*/
+func (s *SQLiteAccountStore) Create(acct *Account) error {
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO accounts (username, password, role, disabled, starts_at, ends_at, demo,
+		totp_secret, recovery_codes, task_quota) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, acct.Username, acct.Password,
+		string(acct.Role), acct.Disabled, formatStoredTime(acct.Start), formatStoredTime(acct.End), acct.Demo,
+		acct.TOTPSecret, strings.Join(acct.RecoveryCodes, ","), acct.Tasks)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errAccountExists
+	}
+	return nil
+}
+
+/*
+Update changes an account within a transaction.
+*/
+func (s *SQLiteAccountStore) Update(username string, fn func(acct *Account) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	acct, err := scanAccount(tx.QueryRow(sqliteAccountSelect+` WHERE username = ?`, username))
+	if err != nil {
+		return err
+	}
+	if err = fn(acct); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`UPDATE accounts SET password = ?, role = ?, disabled = ?, starts_at = ?, ends_at = ?, demo = ?,
+		totp_secret = ?, recovery_codes = ?, task_quota = ? WHERE username = ?`, acct.Password, string(acct.Role),
+		acct.Disabled, formatStoredTime(acct.Start), formatStoredTime(acct.End), acct.Demo,
+		acct.TOTPSecret, strings.Join(acct.RecoveryCodes, ","), acct.Tasks, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Delete removes an account from the database.
+*/
+func (s *SQLiteAccountStore) Delete(username string) error {
+	res, err := s.db.Exec(`DELETE FROM accounts WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errAccountNotFound
+	}
+	return nil
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+/*
+CreateAccountRequest is the structure used to receive a new account from the admin API.
+*/
+type CreateAccountRequest struct {
+	Username string     `json:"Username" binding:"required"`
+	Password string     `json:"Password" binding:"required"`
+	Role     string     `json:"Role"`
+	Start    *time.Time `json:"Start"`
+	End      *time.Time `json:"End"`
+	Demo     bool       `json:"Demo"`
+	Tasks    int        `json:"Tasks"`
+}
+
+/*
+TasksRequest is the structure used to receive the task quota of an account from the admin API.
+Tasks is the number of tasks a session ends after, -1 for no limit or 0 for the server's quota.
+*/
+type TasksRequest struct {
+	Tasks int `json:"Tasks"`
+}
+
+/*
+AccessRequest is the structure used to receive the times an account can log in between from the
+admin API. Leaving a time out removes that limit.
+*/
+type AccessRequest struct {
+	Start *time.Time `json:"Start"`
+	End   *time.Time `json:"End"`
+}
+
+/*
+ResetPasswordRequest is the structure used to receive a new password from the admin API. When the
+password is left empty a random one is generated and returned.
+*/
+type ResetPasswordRequest struct {
+	Password string `json:"Password"`
+}
+
+/*
+getAccounts lists all the accounts without their passwords.
+*/
+func getAccounts(c *gin.Context) {
+	list, err := accounts.List()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, list)
+}
+
+/*
+postAccount creates a new account with a hashed password.
+*/
+func postAccount(c *gin.Context) {
+	var req CreateAccountRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if err := validateUsername(req.Username); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	role, err := ParseRole(req.Role)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Tasks < unlimitedTasks {
+		c.JSON(400, gin.H{"error": errInvalidTaskQuota.Error()})
+		return
+	}
+	hash, err := hashPassword("bcrypt", req.Password)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	acct := &Account{Username: req.Username, Password: hash, Role: role, Start: req.Start, End: req.End,
+		Demo: req.Demo, Tasks: req.Tasks}
+	if !accountsUpdateError(c, accounts.Create(acct)) {
+		return
+	}
+	c.JSON(201, acct)
+}
+
+/*
+postAccountDisable disables an account so it can no longer log in.
+*/
+func postAccountDisable(c *gin.Context) {
+	setAccountDisabled(c, true)
+}
+
+/*
+postAccountEnable enables a previously disabled account.
+*/
+func postAccountEnable(c *gin.Context) {
+	setAccountDisabled(c, false)
+}
+
+func setAccountDisabled(c *gin.Context, disabled bool) {
+	var acct Account
+	err := accounts.Update(c.Param("username"), func(a *Account) error {
+		a.Disabled = disabled
+		acct = *a
+		return nil
+	})
+	if !accountsUpdateError(c, err) {
+		return
+	}
+	c.JSON(200, acct)
+}
+
+/*
+postAccountAccess sets the times the account can log in between.
+*/
+func postAccountAccess(c *gin.Context) {
+	var req AccessRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Start != nil && req.End != nil && !req.End.After(*req.Start) {
+		c.JSON(400, gin.H{"error": "End must be after Start"})
+		return
+	}
+
+	var acct Account
+	err := accounts.Update(c.Param("username"), func(a *Account) error {
+		a.Start = req.Start
+		a.End = req.End
+		acct = *a
+		return nil
+	})
+	if !accountsUpdateError(c, err) {
+		return
+	}
+	c.JSON(200, acct)
+}
+
+/*
+postAccountTasks sets the number of tasks the sessions of the account end after. Sessions that
+have already started keep the quota they started with.
+*/
+func postAccountTasks(c *gin.Context) {
+	var req TasksRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Tasks < unlimitedTasks {
+		c.JSON(400, gin.H{"error": errInvalidTaskQuota.Error()})
+		return
+	}
+
+	var acct Account
+	err := accounts.Update(c.Param("username"), func(a *Account) error {
+		a.Tasks = req.Tasks
+		acct = *a
+		return nil
+	})
+	if !accountsUpdateError(c, err) {
+		return
+	}
+	c.JSON(200, acct)
+}
+
+/*
+postAccountPassword resets the password of an account. If no password is provided a random one
+is generated and returned in the response as it cannot be recovered later.
+*/
+func postAccountPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	props := make(map[string]interface{})
+	if req.Password == "" {
+		pass, err := randomPassword()
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		req.Password = pass
+		props["Password"] = pass
+	}
+	hash, err := hashPassword("bcrypt", req.Password)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	username := c.Param("username")
+	err = accounts.Update(username, func(a *Account) error {
+		a.Password = hash
+		return nil
+	})
+	if !accountsUpdateError(c, err) {
+		return
+	}
+	props["Username"] = username
+	c.JSON(200, props)
+}
+
+/*
+deleteAccount removes an account.
+*/
+func deleteAccount(c *gin.Context) {
+	if !accountsUpdateError(c, accounts.Delete(c.Param("username"))) {
+		return
+	}
+	c.Status(204)
+}
+
+/*
+accountsUpdateError writes the response for a failed change to the account store and returns false,
+or returns true if there was no error.
+*/
+func accountsUpdateError(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case errAccountNotFound:
+		c.JSON(404, gin.H{"error": err.Error()})
+	case errAccountExists, errAccountConflict:
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+	return false
+}
+
+/*
+randomPassword generates a password that is easy to read out to a participant.
+*/
+func randomPassword() (string, error) {
+	b := make([]byte, 9)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*
+deleteUserLockout clears the failed logins and lockout of a username.
+*/
+func deleteUserLockout(c *gin.Context) {
+	if err := clearLockout(lockoutUser, c.Param("username")); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.Status(204)
+}
+
+/*
+deleteIPLockout clears the failed logins and lockout of a client IP.
+*/
+func deleteIPLockout(c *gin.Context) {
+	if err := clearLockout(lockoutIP, c.Param("ip")); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.Status(204)
+}
+
+/*
+ActiveSession is a token that has not expired as listed by the admin API.
+*/
+type ActiveSession struct {
+	ID            string
+	User          string
+	Role          Role
+	Demo          bool
+	Num           int
+	Tasks         int
+	TaskQuota     int
+	Expiration    time.Time
+	MaxExpiration time.Time
+	LastActivity  time.Time
+	Remaining     int64
+}
+
+//activeByUser sorts active sessions by user, then by session number.
+type activeByUser []ActiveSession
+
+func (s activeByUser) Len() int      { return len(s) }
+func (s activeByUser) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s activeByUser) Less(i, j int) bool {
+	if s[i].User != s[j].User {
+		return s[i].User < s[j].User
+	}
+	return s[i].Num < s[j].Num
+}
+
+/*
+ExtendSessionRequest is the structure used to receive how long to extend a session by from the
+admin API or the live sessions page. Leaving it out extends the session by tokenExpiration.
+*/
+type ExtendSessionRequest struct {
+	Minutes int `json:"Minutes" form:"Minutes"`
+}
+
+/*
+activeSessions lists the tokens that have not expired.
+*/
+func activeSessions() ([]ActiveSession, error) {
+	tokens, err := sessions.List()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ActiveSession, 0, len(tokens))
+	for _, t := range tokens {
+		list = append(list, ActiveSession{
+			ID:            t.ID,
+			User:          t.User,
+			Role:          t.Role,
+			Demo:          t.Demo,
+			Num:           t.Num,
+			Tasks:         t.Tasks,
+			TaskQuota:     t.TaskQuota,
+			Expiration:    t.Expiration,
+			MaxExpiration: t.MaxExpiration(),
+			LastActivity:  t.LastActivity,
+			Remaining:     remainingSeconds(t),
+		})
+	}
+	sort.Sort(activeByUser(list))
+	return list, nil
+}
+
+/*
+getActiveSessions lists the sessions that are currently open.
+*/
+func getActiveSessions(c *gin.Context) {
+	list, err := activeSessions()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, list)
+}
+
+/*
+getActiveSessionsPage shows the sessions that are currently open with buttons to expire or extend
+them.
+*/
+func getActiveSessionsPage(c *gin.Context) {
+	list, err := activeSessions()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.HTML(200, "sessions.tmpl", gin.H{
+		"sessions": list,
+		"csrf":     c.MustGet("csrf"),
+		"minutes":  int(tokenExpiration.Minutes()),
+	})
+}
+
+/*
+activeSessionDone responds to an action on a session, sending the live sessions page back to
+where the form was submitted from.
+*/
+func activeSessionDone(c *gin.Context, token *AuthToken) {
+	if c.ContentType() == binding.MIMEPOSTForm {
+		c.Redirect(303, "/admin/sessions/view")
+		return
+	}
+	c.JSON(200, gin.H{
+		"ID":            token.ID,
+		"User":          token.User,
+		"Expiration":    token.Expiration,
+		"MaxExpiration": token.MaxExpiration(),
+	})
+}
+
+/*
+postSessionExpire forces a session to end, logging the participant out. An unfinished session can
+still be resumed afterwards.
+*/
+func postSessionExpire(c *gin.Context) {
+	token, err := sessions.Get(c.Param("id"))
+	if err == errNoToken {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if err := sessions.Expire(token); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	audit(c, auditTokenExpired, token.User, token.ID, "expired by an admin")
+	activeSessionDone(c, token)
+}
+
+/*
+postSessionExtend extends a session by the minutes asked for, or tokenExpiration, from when it
+would have expired. Unlike a refresh by the participant it can go past tokenMaxLifetime.
+*/
+func postSessionExtend(c *gin.Context) {
+	var req ExtendSessionRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.Bind(&req); err != nil {
+			return
+		}
+	}
+	if req.Minutes < 0 {
+		c.JSON(400, gin.H{"error": "Minutes must be a positive number"})
+		return
+	}
+	extension := tokenExpiration
+	if req.Minutes > 0 {
+		extension = time.Duration(req.Minutes) * time.Minute
+	}
+
+	token, err := sessions.Get(c.Param("id"))
+	if err == errNoToken {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	expiration := token.Expiration.Add(extension).Truncate(time.Second)
+	if err := sessions.Extend(token, expiration); err == errNoToken {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	audit(c, auditExtended, token.User, token.ID,
+		"extended to "+expiration.UTC().Format(time.RFC3339)+" by an admin")
+	activeSessionDone(c, token)
+}
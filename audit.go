@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//The events recorded in the audit log.
+const (
+	auditLogin        = "login"
+	auditLoginFailed  = "login_failed"
+	auditLogout       = "logout"
+	auditTokenExpired = "token_expired"
+	auditAdminAction  = "admin"
+	auditTOTP         = "totp"
+	auditDuplicate    = "duplicate_task"
+	auditResumed      = "session_resumed"
+	auditExtended     = "session_extended"
+	auditOutOfOrder   = "task_out_of_order"
+)
+
+/*
+AuditEvent is one line of the audit log. Username is the account the event is about and Actor is
+the logged in user that caused it when that is someone else, such as an admin changing an account.
+*/
+type AuditEvent struct {
+	Time      time.Time
+	Event     string
+	Username  string `json:",omitempty"`
+	TokenID   string `json:",omitempty"`
+	IP        string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+	Actor     string `json:",omitempty"`
+	Detail    string `json:",omitempty"`
+}
+
+/*
+AuditLog is an append only log of authentication events written as one JSON object per line. Once
+the file grows past MaxSize it is rotated to Path.1, the older files moving up by one, and only
+Keep rotated files are kept.
+*/
+type AuditLog struct {
+	Path    string
+	MaxSize int64
+	Keep    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+/*
+NewAuditLog opens the audit log at path, creating it if needed.
+*/
+func NewAuditLog(path string, maxSize int64, keep int) (*AuditLog, error) {
+	a := &AuditLog{Path: path, MaxSize: maxSize, Keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+/*
+Record appends the event to the log, rotating it first if the event would take it past MaxSize.
+A failure to rotate is logged and the event is appended to the current file instead.
+*/
+func (a *AuditLog) Record(ev AuditEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.MaxSize {
+		if err = a.rotate(); err != nil {
+			log.Printf("failed to rotate the audit log, %v", err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+/*
+rotate closes the current file, shifts the rotated files up by one and opens a new file. It must
+be called with mu held. The file at Path is opened again whatever happens to the others, so when
+they can't be shifted events keep being recorded in the current file past MaxSize rather than lost.
+*/
+func (a *AuditLog) rotate() error {
+	err := a.file.Close()
+	if err == nil {
+		err = a.shift()
+	}
+	if openErr := a.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+/*
+shift moves the rotated files up by one, dropping the oldest, and the current file to Path.1.
+*/
+func (a *AuditLog) shift() error {
+	os.Remove(a.rotatedPath(a.Keep))
+	for i := a.Keep - 1; i >= 1; i-- {
+		if err := os.Rename(a.rotatedPath(i), a.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if a.Keep > 0 {
+		return os.Rename(a.Path, a.rotatedPath(1))
+	}
+	return os.Remove(a.Path)
+}
+
+func (a *AuditLog) rotatedPath(n int) string {
+	return a.Path + "." + strconv.Itoa(n)
+}
+
+/*
+Query returns the events of username, or of every user when it is empty, between from and to.
+A zero from or to leaves that end of the range open. The rotated files are read as well, oldest
+first.
+*/
+func (a *AuditLog) Query(username string, from, to time.Time) ([]AuditEvent, error) {
+	files, size, err := a.snapshot()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]AuditEvent, 0)
+	for i, f := range files {
+		var r io.Reader = f
+		if i == len(files)-1 {
+			r = io.LimitReader(f, size)
+		}
+		if events, err = scanAuditEvents(r, events, username, from, to); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+/*
+snapshot opens the rotated files, oldest first, and the current file last, returning the size the
+current file had. Only the files are opened while mu is held, they are read after it is released.
+An open file can still be read after it is rotated and anything written to the current file after
+the snapshot is past the size.
+*/
+func (a *AuditLog) snapshot() ([]*os.File, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var files []*os.File
+	for i := a.Keep; i >= 0; i-- {
+		path := a.Path
+		if i > 0 {
+			path = a.rotatedPath(i)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) && i > 0 {
+			continue
+		} else if err != nil {
+			return files, 0, err
+		}
+		files = append(files, f)
+	}
+	return files, a.size, nil
+}
+
+/*
+scanAuditEvents appends the events read from r that match the filters of Query to events.
+*/
+func scanAuditEvents(r io.Reader, events []AuditEvent, username string, from, to time.Time) ([]AuditEvent, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var ev AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue //A partly written line from a crash
+		}
+		if username != "" && ev.Username != username && ev.Actor != username {
+			continue
+		}
+		if !from.IsZero() && ev.Time.Before(from) || !to.IsZero() && !ev.Time.Before(to) {
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+/*
+audit records an event for the request in the audit log. A failure to write the log is logged but
+does not fail the request.
+*/
+func audit(c *gin.Context, event, username, tokenID, detail string) {
+	if auditLog == nil {
+		return
+	}
+	ev := AuditEvent{
+		Time:      time.Now().UTC(),
+		Event:     event,
+		Username:  username,
+		TokenID:   tokenID,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Detail:    detail,
+	}
+	if t, ok := c.Get("token"); ok {
+		token := t.(*AuthToken)
+		if token.User != username {
+			ev.Actor = token.User
+		}
+	}
+	if err := auditLog.Record(ev); err != nil {
+		log.Printf("failed to write audit log, %v %+v", err, ev)
+	}
+}
+
+/*
+auditAdmin is a middleware that records every change made through the admin API once it has been
+handled. Requests that only read are not recorded.
+*/
+func auditAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.Request.Method == "GET" {
+			return
+		}
+		token := c.MustGet("token").(*AuthToken)
+		detail := c.Request.Method + " " + c.Request.URL.Path + " " + strconv.Itoa(c.Writer.Status())
+		audit(c, auditAdminAction, c.Param("username"), token.ID, detail)
+	}
+}
+
+/*
+getAudit returns the audit log events filtered by the username, from and to query parameters. from
+and to are either RFC 3339 times or dates, to being inclusive of the whole day.
+*/
+func getAudit(c *gin.Context) {
+	var from, to time.Time
+	var err error
+	if s := c.Query("from"); s != "" {
+		if from, err = parseQueryTime(s, false); err != nil {
+			c.JSON(400, gin.H{"error": "invalid from time"})
+			return
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		if to, err = parseQueryTime(s, true); err != nil {
+			c.JSON(400, gin.H{"error": "invalid to time"})
+			return
+		}
+	}
+
+	events, err := auditLog.Query(c.Query("username"), from, to)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, events)
+}
+
+/*
+parseQueryTime parses an RFC 3339 time or one of the formats of parseAccessTime.
+*/
+func parseQueryTime(s string, isEnd bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return parseAccessTime(s, isEnd)
+}
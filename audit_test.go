@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+recordAuditEvents records n events numbered from first in their Detail, a minute apart from start
+and alternating between alice and bob.
+*/
+func recordAuditEvents(t *testing.T, a *AuditLog, start time.Time, first, n int) {
+	for i := first; i < first+n; i++ {
+		username := "alice"
+		if i%2 == 1 {
+			username = "bob"
+		}
+		ev := AuditEvent{Time: start.Add(time.Duration(i) * time.Minute), Event: auditLogin, Username: username,
+			Detail: strconv.Itoa(i)}
+		if err := a.Record(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//checkAuditEvents checks that the events are numbered from first to last in order.
+func checkAuditEvents(t *testing.T, events []AuditEvent, first, last, step int) {
+	if len(events) != (last-first)/step+1 {
+		t.Fatalf("got %v events, want %v to %v", len(events), first, last)
+	}
+	for i, ev := range events {
+		if ev.Detail != strconv.Itoa(first+i*step) {
+			t.Fatalf("event %v is %v, want %v", i, ev.Detail, first+i*step)
+		}
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path, 1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	recordAuditEvents(t, a, start, 0, 40)
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1000 {
+			t.Errorf("%v is %v bytes, past the maximum size", p, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than Keep rotated files were kept, %v", err)
+	}
+
+	//The kept events are the newest, read from the rotated files oldest first
+	events, err := a.Query("", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || len(events) == 40 {
+		t.Fatalf("got %v events, want the newest of 40", len(events))
+	}
+	first, _ := strconv.Atoi(events[0].Detail)
+	checkAuditEvents(t, events, first, 39, 1)
+
+	if events, err = a.Query("bob", time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	checkAuditEvents(t, events, first|1, 39, 2)
+
+	from, to := start.Add(30*time.Minute), start.Add(35*time.Minute)
+	if events, err = a.Query("", from, to); err != nil {
+		t.Fatal(err)
+	}
+	checkAuditEvents(t, events, 30, 34, 1)
+}
+
+func TestAuditLogRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path, 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The current file can't be renamed over a directory that isn't empty
+	if err = os.MkdirAll(filepath.Join(path+".1", "blocked"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	recordAuditEvents(t, a, start, 0, 20)
+
+	if err = os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	events, err := a.Query("", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAuditEvents(t, events, 0, 19, 1)
+
+	//Once the files can be shifted the log is rotated again
+	recordAuditEvents(t, a, start, 20, 1)
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if events, err = a.Query("", time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	checkAuditEvents(t, events, 0, 20, 1)
+}
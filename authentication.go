@@ -1,11 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"log"
-	"os"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 /*
@@ -16,102 +16,352 @@ type AuthenticateRequest struct {
 	Password string `form:"Password" binding:"required"`
 }
 
+//Role determines what an authenticated user is allowed to access.
+type Role string
+
+//The roles an account can be assigned. Accounts without a role are participants.
+const (
+	RoleParticipant Role = "participant"
+	RoleResearcher  Role = "researcher"
+	RoleAdmin       Role = "admin"
+)
+
+//ParseRole converts the text from the accounts file into a Role.
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleParticipant, RoleResearcher, RoleAdmin:
+		return r, nil
+	case "":
+		return RoleParticipant, nil
+	}
+	return "", errInvalidRole
+}
+
+//unlimitedTasks is the task quota of sessions that do not end after a number of tasks.
+const unlimitedTasks = -1
+
+//Account is a single account that can log in, stored by one of the AccountStore backends.
+type Account struct {
+	Username string
+	Password string `json:"-"`
+	Role     Role
+	Disabled bool
+	//Demo accounts are for demonstrations and practice, their results are never recorded.
+	Demo bool `json:",omitempty"`
+	//Start and End limit when the account can log in, End is exclusive. Either can be nil.
+	Start *time.Time `json:",omitempty"`
+	End   *time.Time `json:",omitempty"`
+	//Tasks is the number of tasks a session of the account ends after, unlimitedTasks for no limit
+	//or 0 to use the -taskQuota of the server.
+	Tasks int `json:",omitempty"`
+	//TOTPSecret turns on two-factor authentication, RecoveryCodes are the hashes of the unused
+	//recovery codes.
+	TOTPSecret    string   `json:"-"`
+	RecoveryCodes []string `json:"-"`
+}
+
+/*
+CheckAccess returns an error if the account cannot log in at now because it is disabled or outside
+of its Start and End.
+*/
+func (a *Account) CheckAccess(now time.Time) error {
+	switch {
+	case a.Disabled:
+		return errAccountDisabled
+	case a.Start != nil && now.Before(*a.Start):
+		return errAccessNotStarted
+	case a.End != nil && !now.Before(*a.End):
+		return errAccessEnded
+	}
+	return nil
+}
+
 /*
-Accounts is the the service used to authenticate login requests.
+TaskQuota returns the number of tasks a session of the account ends after.
+*/
+func (a *Account) TaskQuota() int {
+	if a.Tasks != 0 {
+		return a.Tasks
+	}
+	return taskQuota
+}
+
+/*
+parseTaskQuota converts a task quota from the accounts file or the -taskQuota flag, either a
+positive number or unlimited.
+*/
+func parseTaskQuota(s string) (int, error) {
+	if s == "unlimited" {
+		return unlimitedTasks, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errInvalidTaskQuota
+	}
+	return n, nil
+}
+
+/*
+formatTaskQuota converts a task quota into the text parseTaskQuota reads.
+*/
+func formatTaskQuota(n int) string {
+	if n == unlimitedTasks {
+		return "unlimited"
+	}
+	return strconv.Itoa(n)
+}
+
+/*
+AccountStore is implemented by the backends that accounts can be kept in. Get returns
+errAccountNotFound for an unknown username and Create returns errAccountExists for a username that
+is taken. Update applies fn to the stored account and saves the result unless fn returns an error.
+*/
+type AccountStore interface {
+	Get(username string) (*Account, error)
+	List() ([]Account, error)
+	Create(acct *Account) error
+	Update(username string, fn func(acct *Account) error) error
+	Delete(username string) error
+}
+
+/*
+Accounts is the the service used to authenticate login requests against the configured
+AccountStore.
 */
 type Accounts struct {
-	accts    map[string]string
-	acctTime time.Time
-	chanReq  chan *AuthenticateRequest
-	chanRes  chan bool
+	AccountStore
+
+	//LDAP is tried before the AccountStore when set so lab staff can use their directory accounts.
+	LDAP *LDAPAuthenticator
 }
 
 //NewAccounts creates a new Accounts object. This is a helper function
-func NewAccounts() *Accounts {
-	return &Accounts{
-		accts:   make(map[string]string),
-		chanReq: make(chan *AuthenticateRequest),
-		chanRes: make(chan bool),
+func NewAccounts(store AccountStore) *Accounts {
+	return &Accounts{AccountStore: store}
+}
+
+/*
+Challenge looks up the account from the AccountStore and checks the credentials against it. The
+account is returned if the credentials are valid, otherwise errInvalidCredentials is returned. Once
+the credentials are known to be valid the error from Account.CheckAccess is returned if the account
+cannot log in right now. Any other error comes from the AccountStore.
+
+When LDAP is configured the directory is checked first. Users that are not staff in the directory,
+or any user while the directory cannot be reached, are checked against the AccountStore.
+*/
+func (a *Accounts) Challenge(req *AuthenticateRequest) (*Account, error) {
+	if a.LDAP != nil {
+		acct, err := a.LDAP.Authenticate(req.Username, req.Password)
+		switch err {
+		case nil, errInvalidCredentials:
+			return acct, err
+		case errAccountNotFound:
+		default:
+			log.Printf("ldap authentication failed, falling back to the account store, %v", err)
+		}
+	}
+
+	acct, err := a.Get(req.Username)
+	if err == errAccountNotFound {
+		rejectPassword(req.Password)
+		return nil, errInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	if !checkPassword(acct.Password, req.Password) {
+		return nil, errInvalidCredentials
 	}
+	if err = acct.CheckAccess(time.Now()); err != nil {
+		return nil, err
+	}
+	return acct, nil
 }
 
+//accountsByName sorts accounts by their username.
+type accountsByName []Account
+
+func (s accountsByName) Len() int           { return len(s) }
+func (s accountsByName) Less(i, j int) bool { return s[i].Username < s[j].Username }
+func (s accountsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 /*
-Challenge sends the credentials to the Accounts service and returns a boolean on the validity
-of the credentials.
+validateUsername checks that the username can be written to the accounts file and stored in redis.
+It must not be empty or contain whitespace, control characters or the : the fields of the accounts
+file are separated by. Without a : a username can't collide with the prefixed keys in redis.
 */
-func (a *Accounts) Challenge(req *AuthenticateRequest) bool {
-	a.chanReq <- req
-	return <-a.chanRes
+func validateUsername(username string) error {
+	if username == "" {
+		return errInvalidUsername
+	}
+	for _, r := range username {
+		if r == ':' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errInvalidUsername
+		}
+	}
+	return nil
 }
 
 /*
-AccountsService is ran in a separate go rountine and handles the processing of challenge requests
-as well as regularly checking the accounts file for new credential pairs.
+parseAccount parses a single line of the accounts file.
 */
-func (a *Accounts) AccountsService() {
-	check := time.After(0)
-	for {
-		select {
-		case <-check: //Check the accounts file.
-			stat, err := os.Stat(accountPath)
+func parseAccount(txt string) (*Account, error) {
+	parts := strings.Split(txt, ":")
+	if len(parts) < 2 || parts[0] == "" {
+		return nil, errInvalidFormat
+	}
+	acct := &Account{
+		Username: parts[0],
+		Password: parts[1],
+		Role:     RoleParticipant,
+	}
+	for _, field := range parts[2:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, errInvalidFormat
+		}
+		switch kv[0] {
+		case "role":
+			role, err := ParseRole(kv[1])
 			if err != nil {
-				log.Fatalf("failed to stat accounts file, %v", err)
+				return nil, err
 			}
-
-			check = time.After(accountCheck)
-			lastMod := stat.ModTime()
-
-			if a.acctTime.IsZero() || lastMod.After(a.acctTime) {
-				a.accts, err = parseAccountsFile()
-				if err != nil {
-					log.Printf("error parsing accounts file, %v", err)
-				}
-				a.acctTime = lastMod
+			acct.Role = role
+		case "disabled":
+			acct.Disabled = kv[1] == "true"
+		case "demo":
+			acct.Demo = kv[1] == "true"
+		case "totp":
+			acct.TOTPSecret = kv[1]
+		case "recovery":
+			acct.RecoveryCodes = splitList(kv[1])
+		case "tasks":
+			n, err := parseTaskQuota(kv[1])
+			if err != nil {
+				return nil, err
 			}
-
-		case req := <-a.chanReq: //Process Challenge Request
-			if pass, ok := a.accts[req.Username]; ok && pass == req.Password {
-				a.chanRes <- true
+			acct.Tasks = n
+		case "start", "end":
+			t, err := parseAccessTime(kv[1], kv[0] == "end")
+			if err != nil {
+				return nil, err
+			}
+			if kv[0] == "start" {
+				acct.Start = &t
 			} else {
-				a.chanRes <- false
+				acct.End = &t
 			}
+		default:
+			return nil, errUnknownField
 		}
 	}
+	return acct, nil
 }
 
 /*
-parseAccountsFile opens accounts and reads in the credential pairs. The expected format for the file is:
+formatAccount converts the account into a line for the accounts file. Default values are left out
+so the line matches what an administrator would write by hand.
+*/
+func formatAccount(acct *Account) string {
+	fields := []string{acct.Username, acct.Password}
+	if acct.Role != RoleParticipant {
+		fields = append(fields, "role="+string(acct.Role))
+	}
+	if acct.Disabled {
+		fields = append(fields, "disabled=true")
+	}
+	if acct.Demo {
+		fields = append(fields, "demo=true")
+	}
+	if acct.Start != nil {
+		fields = append(fields, "start="+formatAccessTime(*acct.Start, false))
+	}
+	if acct.End != nil {
+		fields = append(fields, "end="+formatAccessTime(*acct.End, true))
+	}
+	if acct.Tasks != 0 {
+		fields = append(fields, "tasks="+formatTaskQuota(acct.Tasks))
+	}
+	if acct.TOTPSecret != "" {
+		fields = append(fields, "totp="+acct.TOTPSecret)
+	}
+	if len(acct.RecoveryCodes) > 0 {
+		fields = append(fields, "recovery="+strings.Join(acct.RecoveryCodes, ","))
+	}
+	return strings.Join(fields, ":")
+}
 
-	username:password
+/*
+The accounts file uses ":" as a separator so access times are written either as a date or in the
+same compact form as the results file names, in the server's time zone.
+*/
+const (
+	accessDateFormat = "2006-01-02"
+	accessTimeFormat = "20060102T150405"
+)
 
-Use the checkAccount flag to set how often the accounts file is scanned for changes.
+/*
+parseAccessTime parses a start or end time from the accounts file. A date on its own for an end
+time means the account can be used until the end of that day.
 */
-func parseAccountsFile() (map[string]string, error) {
-	f, err := os.Open(accountPath)
+func parseAccessTime(s string, isEnd bool) (time.Time, error) {
+	if t, err := time.ParseInLocation(accessDateFormat, s, time.Local); err == nil {
+		if isEnd {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.ParseInLocation(accessTimeFormat, s, time.Local)
 	if err != nil {
-		return nil, err
+		return time.Time{}, errInvalidFormat
 	}
+	return t, nil
+}
 
-	defer f.Close()
-
-	accts := make(map[string]string)
-
-	scanner := bufio.NewScanner(f)
+/*
+formatAccessTime is the reverse of parseAccessTime, times at midnight are written as dates.
+*/
+func formatAccessTime(t time.Time, isEnd bool) string {
+	t = t.In(time.Local)
+	if t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0 || t.Nanosecond() != 0 {
+		return t.Format(accessTimeFormat)
+	}
+	if isEnd {
+		t = t.AddDate(0, 0, -1)
+	}
+	return t.Format(accessDateFormat)
+}
 
-	for scanner.Scan() {
-		txt := scanner.Text()
-		if txt == "" {
-			continue
-		}
-		parts := strings.Split(txt, ":")
-		if len(parts) != 2 {
-			log.Println("ignored line \"", txt, "\" as it does not follow the correct schema")
-			continue
-		}
-		accts[parts[0]] = parts[1]
+/*
+parseStoredTime parses an optional time kept by the redis and sqlite account stores, empty values
+are nil.
+*/
+func parseStoredTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
 	}
-	if err = scanner.Err(); err != nil {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
 		return nil, err
 	}
-	return accts, nil
+	return &t, nil
+}
+
+/*
+formatStoredTime is the reverse of parseStoredTime.
+*/
+func formatStoredTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+/*
+splitList splits a comma separated list, an empty string is an empty list.
+*/
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//authCookie is the name of the cookie holding the signed id of the AuthToken.
+const authCookie = "X-Auth-Token"
+
+/*
+CookieSigner signs cookie values with HMAC-SHA256 so values that were tampered with or guessed are
+rejected without looking them up. Previous is the secret used before the last rotation, values
+signed with it are accepted until PreviousUntil so sessions survive a change of secret.
+*/
+type CookieSigner struct {
+	Current       []byte
+	Previous      []byte
+	PreviousUntil time.Time
+}
+
+/*
+NewCookieSigner creates a CookieSigner from the secrets. When current is empty a random secret is
+generated, which means cookies stop working when the server restarts.
+*/
+func NewCookieSigner(current, previous string, grace time.Duration) (*CookieSigner, error) {
+	s := &CookieSigner{Current: []byte(current)}
+	if current == "" {
+		s.Current = make([]byte, 32)
+		if _, err := rand.Read(s.Current); err != nil {
+			return nil, err
+		}
+	}
+	if previous != "" {
+		s.Previous = []byte(previous)
+		s.PreviousUntil = time.Now().Add(grace)
+	}
+	return s, nil
+}
+
+func cookieMAC(secret []byte, value string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+/*
+Sign returns the value with its signature appended after a dot.
+*/
+func (s *CookieSigner) Sign(value string) string {
+	return value + "." + base64.RawURLEncoding.EncodeToString(cookieMAC(s.Current, value))
+}
+
+/*
+Verify checks the signature of a signed value and returns the value. resign is true when the
+value was signed with the previous secret and the cookie should be set again with the current one.
+*/
+func (s *CookieSigner) Verify(signed string) (value string, resign bool, err error) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false, errInvalidCookie
+	}
+	value = signed[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil {
+		return "", false, errInvalidCookie
+	}
+	if hmac.Equal(sig, cookieMAC(s.Current, value)) {
+		return value, false, nil
+	}
+	if s.Previous != nil && time.Now().Before(s.PreviousUntil) && hmac.Equal(sig, cookieMAC(s.Previous, value)) {
+		return value, true, nil
+	}
+	return "", false, errInvalidCookie
+}
+
+/*
+setAuthCookie sets the cookie holding the signed id of the AuthToken used to authenticate later
+requests. Under https the cookie is only sent over TLS.
+*/
+func setAuthCookie(c *gin.Context, token *AuthToken) {
+	cookie := &http.Cookie{
+		Name:     authCookie,
+		Value:    cookieSigner.Sign(token.ID),
+		Path:     "/",
+		Expires:  token.Expiration,
+		HttpOnly: true,
+		Secure:   httpsAddr != "",
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(c.Writer, cookie)
+}
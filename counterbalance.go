@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+defaultTaskOrders is the Latin square of the AST, Arrow Flanker, Trails B and RAT battery used when
+-taskOrders is not set. Each row is a group of participants and holds the order of the tasks of
+each of their sessions, numbering the tasks of -tasks from 1.
+*/
+var defaultTaskOrders = [][][]int{
+	{{1, 2, 3, 4}, {2, 1, 4, 3}, {3, 4, 1, 2}, {4, 3, 2, 1}},
+	{{2, 1, 4, 3}, {3, 4, 1, 2}, {4, 3, 2, 1}, {1, 2, 3, 4}},
+	{{3, 4, 1, 2}, {4, 3, 2, 1}, {1, 2, 3, 4}, {2, 1, 4, 3}},
+	{{4, 3, 2, 1}, {1, 2, 3, 4}, {2, 1, 4, 3}, {3, 4, 1, 2}},
+}
+
+/*
+loadTaskOrders reads the order matrix from the file at path, or uses defaultTaskOrders when path is
+empty. Every line of the file is a group of participants, the orders of its sessions separated by
+spaces and the tasks of an order by commas, e.g. "1,2,3,4 2,1,4,3". Blank lines and lines starting
+with # are skipped. Without a file a battery other than the default one is run in the order of
+-tasks.
+*/
+func loadTaskOrders(path string) ([][][]string, error) {
+	if path == "" {
+		if len(taskNames) != 4 {
+			return [][][]string{{taskNames}}, nil
+		}
+		return resolveTaskOrders(defaultTaskOrders)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var matrix [][][]int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var group [][]int
+		for _, field := range strings.Fields(line) {
+			var order []int
+			for _, s := range strings.Split(field, ",") {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, errInvalidTaskOrder
+				}
+				order = append(order, n)
+			}
+			group = append(group, order)
+		}
+		matrix = append(matrix, group)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return resolveTaskOrders(matrix)
+}
+
+/*
+resolveTaskOrders replaces the task numbers of the matrix with the names of the tasks. Every order
+must name each task at most once.
+*/
+func resolveTaskOrders(matrix [][][]int) ([][][]string, error) {
+	if len(matrix) == 0 {
+		return nil, errInvalidTaskOrder
+	}
+	orders := make([][][]string, len(matrix))
+	for i, group := range matrix {
+		for _, order := range group {
+			seen := make(map[int]bool, len(order))
+			names := make([]string, len(order))
+			for j, n := range order {
+				if n < 1 || n > len(taskNames) || seen[n] {
+					return nil, errInvalidTaskOrder
+				}
+				seen[n] = true
+				names[j] = taskNames[n-1]
+			}
+			orders[i] = append(orders[i], names)
+		}
+	}
+	return orders, nil
+}
+
+/*
+sessionTaskOrder returns the order the tasks of the session are run in, picked from taskOrders by
+the group of the participant and the session number. Demo and staff sessions take the first group
+so they do not use up an assignment.
+*/
+func sessionTaskOrder(token *AuthToken) ([]string, int, error) {
+	group := 0
+	if token.Participant() {
+		var err error
+		if group, err = ledger.Group(token.User, len(taskOrders)); err != nil {
+			return nil, 0, err
+		}
+	}
+	orders := taskOrders[group%len(taskOrders)]
+	return orders[(token.Num-1)%len(orders)], group, nil
+}
+
+/*
+checkTaskOrder returns the task that should have been completed next if task is not the next one of
+the order, or "" if it is. Tasks that are not in the order or were already completed are in order.
+*/
+func checkTaskOrder(token *AuthToken, order []string, task string) string {
+	if _, done := token.Completed[task]; done || taskPosition(order, task) == 0 {
+		return ""
+	}
+	for _, t := range order {
+		if _, done := token.Completed[t]; done {
+			continue
+		}
+		if t == task {
+			return ""
+		}
+		return t
+	}
+	return ""
+}
+
+/*
+taskPosition returns the position of the task in the order counting from 1, 0 if it is not in it.
+*/
+func taskPosition(order []string, task string) int {
+	for i, t := range order {
+		if t == task {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+setDefaultTaskOrders runs the test with the default battery, its Latin square and a new ledger to
+assign the groups from.
+*/
+func setDefaultTaskOrders(t *testing.T) [][][]string {
+	prevNames, prevOrders, prevLedger := taskNames, taskOrders, ledger
+	t.Cleanup(func() { taskNames, taskOrders, ledger = prevNames, prevOrders, prevLedger })
+
+	taskNames = []string{"Arithmetic", "Flanker", "TrailsA", "Remote Associates"}
+	orders, err := loadTaskOrders("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskOrders = orders
+	ledger = newTestLedger(t)
+	return orders
+}
+
+func TestSessionTaskOrder(t *testing.T) {
+	orders := setDefaultTaskOrders(t)
+
+	//Demo and staff sessions run the first group without being assigned one
+	for _, token := range []*AuthToken{
+		{User: "demo", Role: RoleParticipant, Demo: true, Num: 2},
+		{User: "researcher", Role: RoleResearcher, Num: 3},
+	} {
+		order, group, err := sessionTaskOrder(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group != 0 || !reflect.DeepEqual(order, orders[0][token.Num-1]) {
+			t.Errorf("%v runs %v of group %v, want %v of group 0", token.User, order, group, orders[0][token.Num-1])
+		}
+	}
+
+	//Each participant cycles through the orders of their group by session number
+	for i, user := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		for num := 1; num <= 9; num++ {
+			order, group, err := sessionTaskOrder(&AuthToken{User: user, Role: RoleParticipant, Num: num})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := orders[i%4][(num-1)%4]
+			if group != i%4 || !reflect.DeepEqual(order, want) {
+				t.Errorf("session %v of %v runs %v of group %v, want %v of group %v", num, user, order, group,
+					want, i%4)
+			}
+		}
+	}
+}
+
+func TestCheckTaskOrder(t *testing.T) {
+	order := []string{"Flanker", "Arithmetic", "TrailsA"}
+	for _, test := range []struct {
+		completed []string
+		task      string
+		want      string
+	}{
+		{nil, "Flanker", ""},
+		{nil, "Arithmetic", "Flanker"},
+		{nil, "TrailsA", "Flanker"},
+		{[]string{"Flanker"}, "Arithmetic", ""},
+		{[]string{"Flanker"}, "TrailsA", "Arithmetic"},
+		{[]string{"Arithmetic"}, "TrailsA", "Flanker"},
+		{[]string{"Arithmetic"}, "Flanker", ""},
+		//Duplicates and tasks that are not in the order are never out of order
+		{[]string{"Flanker", "TrailsA"}, "TrailsA", ""},
+		{nil, "Remote Associates", ""},
+	} {
+		token := &AuthToken{Completed: make(map[string]time.Time)}
+		for _, task := range test.completed {
+			token.Completed[task] = time.Now()
+		}
+		if got := checkTaskOrder(token, order, test.task); got != test.want {
+			t.Errorf("%v after %v expected %q, want %q", test.task, test.completed, got, test.want)
+		}
+	}
+}
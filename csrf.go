@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+/*
+CSRF protection uses a double submit cookie. Every client is given a random token in the
+X-CSRF-Token cookie and state changing requests must send the same token back in the X-CSRF-Token
+header or the csrf_token form field. Another site can make the browser send the cookie but cannot
+read it, so it cannot send the matching header or field.
+*/
+const (
+	csrfCookie = "X-CSRF-Token"
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+/*
+newCSRFToken generates a random CSRF token.
+*/
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*
+csrfProtect is a middleware that gives each client a CSRF token and refuses POST, PUT, PATCH and
+DELETE requests that do not send it back with 403. The token is stored in the context as "csrf"
+for pages and responses that hand it to the client.
+*/
+func csrfProtect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var token string
+		if cookie, err := c.Request.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			if token, err = newCSRFToken(); err != nil {
+				c.AbortWithError(500, err)
+				return
+			}
+			http.SetCookie(c.Writer, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   httpsAddr != "",
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		c.Set("csrf", token)
+
+		switch c.Request.Method {
+		case "GET", "HEAD", "OPTIONS":
+			return
+		}
+		//Bearer tokens are not sent by the browser on its own and the token login only returns the
+		//token in the response, which another site cannot read
+		if _, ok := bearerToken(c); ok || strings.HasPrefix(c.Request.URL.Path, "/login/token") {
+			return
+		}
+
+		sent := c.Request.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = c.Request.PostFormValue(csrfField)
+		}
+		if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			//The login pages are shown again so a participant with an old page can simply retry
+			if c.Request.URL.Path == "/login" && c.ContentType() == binding.MIMEPOSTForm {
+				c.HTML(403, "login.tmpl", gin.H{
+					"oidc":    oidcProvider != nil,
+					"csrf":    token,
+					"message": "The login page had expired, please try again.",
+				})
+			} else if strings.HasPrefix(c.Request.URL.Path, "/login/code/") && c.ContentType() == binding.MIMEPOSTForm {
+				c.HTML(403, "code.tmpl", gin.H{
+					"csrf":    token,
+					"message": "The page had expired, please try again.",
+				})
+			} else {
+				c.JSON(403, gin.H{"error": "missing or invalid CSRF token, reload the page and try again"})
+			}
+			c.Abort()
+			return
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fzzy/radix/redis"
+	"github.com/gin-gonic/gin"
+)
+
+//enrollCodesSet is the redis set holding all the enrollment codes so they can be listed.
+const enrollCodesSet = "enroll:codes"
+
+/*
+EnrollmentCode lets a participant log in by following a link instead of typing a username and
+password. Each code belongs to one account and can be used MaxUses times until it expires.
+*/
+type EnrollmentCode struct {
+	Code      string
+	Username  string
+	MaxUses   int
+	Uses      int
+	Expires   time.Time
+	Created   time.Time
+	CreatedBy string
+}
+
+/*
+CreateEnrollmentCodeRequest is the structure used to receive a new enrollment code from the admin
+API. MaxUses defaults to 1 and ExpiresIn, in seconds, defaults to 7 days.
+*/
+type CreateEnrollmentCodeRequest struct {
+	Username  string `json:"Username" binding:"required"`
+	MaxUses   int    `json:"MaxUses"`
+	ExpiresIn int64  `json:"ExpiresIn"`
+}
+
+func enrollKey(code string) string {
+	return "enroll:" + code
+}
+
+/*
+newEnrollmentCodeValue generates a random code that is easy to read out and type, without the
+padding or lower case letters of base32.
+*/
+func newEnrollmentCodeValue() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+/*
+NewEnrollmentCode creates a new code for the username and stores it in redis until it expires.
+*/
+func NewEnrollmentCode(username, createdBy string, maxUses int, expiresIn time.Duration) (*EnrollmentCode, error) {
+	value, err := newEnrollmentCodeValue()
+	if err != nil {
+		return nil, err
+	}
+	code := &EnrollmentCode{
+		Code:      value,
+		Username:  username,
+		MaxUses:   maxUses,
+		Created:   time.Now(),
+		CreatedBy: createdBy,
+	}
+	code.Expires = code.Created.Add(expiresIn)
+
+	c, err := rpool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	c.Append("HMSET", enrollKey(code.Code),
+		"Username", code.Username,
+		"MaxUses", code.MaxUses,
+		"Uses", code.Uses,
+		"Expires", code.Expires.Format(time.RFC3339),
+		"Created", code.Created.Format(time.RFC3339),
+		"CreatedBy", code.CreatedBy)
+	c.Append("EXPIRE", enrollKey(code.Code), int64(expiresIn.Seconds()))
+	c.Append("SADD", enrollCodesSet, code.Code)
+	for i := 0; i < 3; i++ {
+		if err = c.GetReply().Err; err != nil {
+			return nil, err
+		}
+	}
+	return code, nil
+}
+
+/*
+parseEnrollmentCode converts the fields of a code hash into an EnrollmentCode.
+*/
+func parseEnrollmentCode(value string, vals map[string]string) (*EnrollmentCode, error) {
+	code := &EnrollmentCode{
+		Code:      value,
+		Username:  vals["Username"],
+		CreatedBy: vals["CreatedBy"],
+	}
+	var err error
+	if code.MaxUses, err = strconv.Atoi(vals["MaxUses"]); err != nil {
+		return nil, err
+	}
+	if code.Uses, err = strconv.Atoi(vals["Uses"]); err != nil {
+		return nil, err
+	}
+	if code.Expires, err = time.Parse(time.RFC3339, vals["Expires"]); err != nil {
+		return nil, err
+	}
+	if code.Created, err = time.Parse(time.RFC3339, vals["Created"]); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+/*
+GetEnrollmentCode returns the code without using it. errInvalidCode is returned for unknown,
+expired, revoked or used up codes.
+*/
+func GetEnrollmentCode(value string) (*EnrollmentCode, error) {
+	value = strings.ToUpper(value)
+	c, err := rpool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var vals map[string]string
+	if vals, err = c.Cmd("HGETALL", enrollKey(value)).Hash(); err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return nil, errInvalidCode
+	}
+	var code *EnrollmentCode
+	if code, err = parseEnrollmentCode(value, vals); err != nil {
+		return nil, err
+	}
+	if code.Uses >= code.MaxUses || code.Expires.Before(time.Now()) {
+		return nil, errInvalidCode
+	}
+	return code, nil
+}
+
+/*
+RedeemEnrollmentCode uses up one of the uses of the code and returns the username it belongs to.
+errInvalidCode is returned for unknown, expired, revoked or used up codes. The code is watched
+while it is checked so two logins cannot both take its last use.
+*/
+func RedeemEnrollmentCode(value string) (string, error) {
+	value = strings.ToUpper(value)
+	c, err := rpool.Get()
+	if err != nil {
+		return "", err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	key := enrollKey(value)
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = c.Cmd("WATCH", key).Err; err != nil {
+			return "", err
+		}
+		var vals map[string]string
+		if vals, err = c.Cmd("HGETALL", key).Hash(); err != nil {
+			c.Cmd("UNWATCH")
+			return "", err
+		}
+		if len(vals) == 0 {
+			c.Cmd("UNWATCH")
+			return "", errInvalidCode
+		}
+		var code *EnrollmentCode
+		if code, err = parseEnrollmentCode(value, vals); err != nil {
+			c.Cmd("UNWATCH")
+			return "", err
+		}
+		if code.Uses >= code.MaxUses || code.Expires.Before(time.Now()) {
+			c.Cmd("UNWATCH")
+			return "", errInvalidCode
+		}
+
+		if err = c.Cmd("MULTI").Err; err != nil {
+			return "", err
+		}
+		c.Cmd("HINCRBY", key, "Uses", 1)
+		rep := c.Cmd("EXEC")
+		if rep.Err != nil {
+			err = rep.Err
+			return "", err
+		} else if rep.Type != redis.NilReply {
+			return code.Username, nil
+		}
+	}
+	return "", errAccountConflict
+}
+
+/*
+ListEnrollmentCodes returns the codes that have not expired, optionally only those of username,
+sorted by when they were created.
+*/
+func ListEnrollmentCodes(username string) ([]EnrollmentCode, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var values []string
+	if values, err = c.Cmd("SMEMBERS", enrollCodesSet).List(); err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		c.Append("HGETALL", enrollKey(value))
+	}
+
+	codes := make([]EnrollmentCode, 0, len(values))
+	var expired []interface{}
+	for _, value := range values {
+		var vals map[string]string
+		if vals, err = c.GetReply().Hash(); err != nil {
+			return nil, err
+		}
+		if len(vals) == 0 {
+			expired = append(expired, value)
+			continue
+		}
+		var code *EnrollmentCode
+		if code, err = parseEnrollmentCode(value, vals); err != nil {
+			return nil, err
+		}
+		if username == "" || code.Username == username {
+			codes = append(codes, *code)
+		}
+	}
+	if len(expired) > 0 {
+		if err = c.Cmd("SREM", append([]interface{}{enrollCodesSet}, expired...)...).Err; err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(codesByCreated(codes))
+	return codes, nil
+}
+
+/*
+RevokeEnrollmentCode deletes the code so it can no longer be used.
+*/
+func RevokeEnrollmentCode(value string) error {
+	value = strings.ToUpper(value)
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var removed int
+	if removed, err = c.Cmd("DEL", enrollKey(value)).Int(); err != nil {
+		return err
+	}
+	if err = c.Cmd("SREM", enrollCodesSet, value).Err; err != nil {
+		return err
+	}
+	if removed == 0 {
+		return errInvalidCode
+	}
+	return nil
+}
+
+//codesByCreated sorts enrollment codes by when they were created.
+type codesByCreated []EnrollmentCode
+
+func (s codesByCreated) Len() int           { return len(s) }
+func (s codesByCreated) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+func (s codesByCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+/*
+getLoginCode shows the page of a login link asking the participant to continue. The code is only
+used once they do, so link previews and prefetching can't use it up and another site can't log a
+browser in with it.
+*/
+func getLoginCode(c *gin.Context) {
+	c.HTML(200, "code.tmpl", gin.H{"csrf": c.MustGet("csrf")})
+}
+
+/*
+postLoginCode logs a participant in with the enrollment code of a login link. The code is only
+used up once the account is known to be able to log in. Failed codes count against the client IP
+so codes cannot be guessed.
+*/
+func postLoginCode(c *gin.Context) {
+	ip := c.ClientIP()
+	if wait, err := loginLockout("", ip); err != nil {
+		c.AbortWithError(500, err)
+		return
+	} else if wait > 0 {
+		audit(c, auditLoginFailed, "", "", "locked out")
+		redirectLocked(c, wait)
+		return
+	}
+
+	code, err := GetEnrollmentCode(c.Param("code"))
+	var username string
+	var acct *Account
+	if err == nil {
+		username = code.Username
+		acct, err = accounts.Get(username)
+		if err == nil && acct.Role != RoleParticipant || err == errAccountNotFound {
+			err = errInvalidCode
+		} else if err == nil {
+			err = acct.CheckAccess(time.Now())
+		}
+	}
+	if err == nil {
+		_, err = RedeemEnrollmentCode(code.Code)
+	}
+	if reason, ok := accessReasons[err]; ok {
+		audit(c, auditLoginFailed, username, "", err.Error())
+		c.Redirect(303, "/login?access="+reason)
+		return
+	} else if err == errInvalidCode {
+		audit(c, auditLoginFailed, username, "", "invalid enrollment code")
+		wait, err := recordLoginFailure("", ip)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		if wait > 0 {
+			redirectLocked(c, wait)
+			return
+		}
+		c.Redirect(303, "/login?code=invalid")
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	token, err := createSession(acct)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	audit(c, auditLogin, acct.Username, token.ID, "enrollment code")
+	setAuthCookie(c, token)
+	c.Redirect(303, "/")
+}
+
+/*
+postEnrollmentCode creates an enrollment code for a participant account and returns it with the
+login link to hand out.
+*/
+func postEnrollmentCode(c *gin.Context) {
+	var req CreateEnrollmentCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.MaxUses < 1 {
+		req.MaxUses = 1
+	}
+	if req.ExpiresIn <= 0 {
+		req.ExpiresIn = 7 * 24 * 60 * 60
+	}
+
+	acct, err := accounts.Get(req.Username)
+	if err == errAccountNotFound {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if acct.Role != RoleParticipant {
+		c.JSON(400, gin.H{"error": "enrollment codes can only be created for participants"})
+		return
+	}
+
+	token := c.MustGet("token").(*AuthToken)
+	code, err := NewEnrollmentCode(acct.Username, token.User, req.MaxUses, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	scheme := "http"
+	if httpsAddr != "" {
+		scheme = "https"
+	}
+	c.JSON(201, gin.H{
+		"Code": code,
+		"URL":  scheme + "://" + c.Request.Host + "/login/code/" + code.Code,
+	})
+}
+
+/*
+getEnrollmentCodes lists the enrollment codes, filtered by the username query parameter if set.
+*/
+func getEnrollmentCodes(c *gin.Context) {
+	codes, err := ListEnrollmentCodes(c.Query("username"))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, codes)
+}
+
+/*
+deleteEnrollmentCode revokes an enrollment code.
+*/
+func deleteEnrollmentCode(c *gin.Context) {
+	if err := RevokeEnrollmentCode(c.Param("code")); err == errInvalidCode {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.Status(204)
+}
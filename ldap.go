@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+/*
+ldapConn is the part of an LDAP connection used by LDAPAuthenticator. It is satisfied by
+*ldap.Conn and lets an in-process stand-in replace the directory server.
+*/
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+/*
+LDAPAuthenticator checks credentials of lab staff against a directory server using search and
+bind. The service account finds the user entry with UserFilter, the user's password is checked by
+binding as that entry and the groups in GroupAttr are mapped to a role.
+*/
+type LDAPAuthenticator struct {
+	URL             string
+	StartTLS        bool
+	BindDN          string
+	BindPassword    string
+	BaseDN          string
+	UserFilter      string
+	GroupAttr       string
+	AdminGroup      string
+	ResearcherGroup string
+
+	//Dial opens the connection to the directory, it defaults to dialing URL.
+	Dial func() (ldapConn, error)
+}
+
+/*
+NewLDAPAuthenticator creates an LDAPAuthenticator that dials the server at rawurl, which must use
+the ldap or ldaps scheme.
+*/
+func NewLDAPAuthenticator(rawurl string) (*LDAPAuthenticator, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, errInvalidLDAPURL
+	}
+	l := &LDAPAuthenticator{
+		URL:        rawurl,
+		UserFilter: "(uid=%s)",
+		GroupAttr:  "memberOf",
+	}
+	l.Dial = func() (ldapConn, error) {
+		return l.dial(u)
+	}
+	return l, nil
+}
+
+/*
+dial connects to the directory server, upgrading the connection with StartTLS if enabled.
+*/
+func (l *LDAPAuthenticator) dial(u *url.URL) (ldapConn, error) {
+	host := u.Host
+	tlsConfig := &tls.Config{ServerName: u.Hostname()}
+
+	if u.Scheme == "ldaps" {
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "636")
+		}
+		conn, err := ldap.DialTLS("tcp", host, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(10 * time.Second)
+		return conn, nil
+	}
+
+	if u.Port() == "" {
+		host = net.JoinHostPort(host, "389")
+	}
+	conn, err := ldap.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(10 * time.Second)
+	if l.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+/*
+Authenticate checks the credentials against the directory. errAccountNotFound is returned when the
+user is not in the directory or is not a member of one of the staff groups, so the caller can fall
+back to the local accounts. errInvalidCredentials is returned when the user exists but the password
+is wrong.
+*/
+func (l *LDAPAuthenticator) Authenticate(username, password string) (*Account, error) {
+	//An empty password would be an unauthenticated bind which most servers accept.
+	if password == "" {
+		return nil, errInvalidCredentials
+	}
+
+	conn, err := l.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = conn.Bind(l.BindDN, l.BindPassword); err != nil {
+		return nil, err
+	}
+
+	req := ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(username)), []string{"dn", l.GroupAttr}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, errAccountNotFound
+	}
+	entry := res.Entries[0]
+
+	role := l.role(entry.GetAttributeValues(l.GroupAttr))
+	if role == "" {
+		return nil, errAccountNotFound
+	}
+
+	if err = conn.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, errInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &Account{Username: username, Role: role}, nil
+}
+
+/*
+role maps the groups of a user to the highest role they grant. An empty role is returned if none
+of the groups are staff groups.
+*/
+func (l *LDAPAuthenticator) role(groups []string) Role {
+	var role Role
+	for _, group := range groups {
+		switch {
+		case l.AdminGroup != "" && strings.EqualFold(group, l.AdminGroup):
+			return RoleAdmin
+		case l.ResearcherGroup != "" && strings.EqualFold(group, l.ResearcherGroup):
+			role = RoleResearcher
+		}
+	}
+	return role
+}
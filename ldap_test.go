@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/ldap.v2"
+)
+
+//ldapUser is an entry of the fakeDirectory.
+type ldapUser struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+/*
+fakeDirectory stands in for a directory server. Users are found by the uid of the filter and every
+bind is recorded so the tests can check what reached the server.
+*/
+type fakeDirectory struct {
+	users map[string]ldapUser
+	binds []string
+}
+
+func (d *fakeDirectory) Bind(username, password string) error {
+	d.binds = append(d.binds, username)
+	if username == "cn=service,dc=lab" && password == "service" {
+		return nil
+	}
+	for _, u := range d.users {
+		if u.dn == username && u.password == password {
+			return nil
+		}
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (d *fakeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	uid := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(uid="), ")")
+	res := &ldap.SearchResult{}
+	if u, ok := d.users[uid]; ok {
+		res.Entries = append(res.Entries, ldap.NewEntry(u.dn, map[string][]string{"memberOf": u.groups}))
+	}
+	return res, nil
+}
+
+func (d *fakeDirectory) Close() {}
+
+func newFakeDirectory(t *testing.T) (*LDAPAuthenticator, *fakeDirectory) {
+	d := &fakeDirectory{users: map[string]ldapUser{
+		"alice": {"uid=alice,dc=lab", "secret", []string{"cn=staff,dc=lab", "cn=admins,dc=lab"}},
+		"bob":   {"uid=bob,dc=lab", "secret", []string{"cn=staff,dc=lab"}},
+		"eve":   {"uid=eve,dc=lab", "secret", []string{"cn=students,dc=lab"}},
+	}}
+	l, err := NewLDAPAuthenticator("ldap://ldap.lab.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.BindDN = "cn=service,dc=lab"
+	l.BindPassword = "service"
+	l.BaseDN = "dc=lab"
+	l.AdminGroup = "CN=admins,DC=lab"
+	l.ResearcherGroup = "cn=staff,dc=lab"
+	l.Dial = func() (ldapConn, error) {
+		return d, nil
+	}
+	return l, d
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	l, _ := newFakeDirectory(t)
+
+	tests := []struct {
+		username string
+		password string
+		role     Role
+		err      error
+	}{
+		{"alice", "secret", RoleAdmin, nil},
+		{"bob", "secret", RoleResearcher, nil},
+		{"bob", "wrong", "", errInvalidCredentials},
+		{"eve", "secret", "", errAccountNotFound},
+		{"mallory", "secret", "", errAccountNotFound},
+	}
+	for _, test := range tests {
+		acct, err := l.Authenticate(test.username, test.password)
+		if err != test.err {
+			t.Errorf("%v: got %v, want %v", test.username, err, test.err)
+			continue
+		}
+		if err == nil && (acct.Username != test.username || acct.Role != test.role) {
+			t.Errorf("%v: got %v %v, want %v", test.username, acct.Username, acct.Role, test.role)
+		}
+	}
+}
+
+func TestLDAPAuthenticateEmptyPassword(t *testing.T) {
+	l, d := newFakeDirectory(t)
+
+	if _, err := l.Authenticate("bob", ""); err != errInvalidCredentials {
+		t.Errorf("got %v, want %v", err, errInvalidCredentials)
+	}
+	if len(d.binds) != 0 {
+		t.Errorf("an empty password reached the directory with binds %v", d.binds)
+	}
+}
+
+func TestLDAPAuthenticateFilter(t *testing.T) {
+	l, d := newFakeDirectory(t)
+
+	//The username is escaped so it can't widen the filter to another entry
+	d.users["*"] = d.users["alice"]
+	if _, err := l.Authenticate("*", "secret"); err != errAccountNotFound {
+		t.Errorf("got %v, want %v", err, errAccountNotFound)
+	}
+}
+
+func TestLDAPFallback(t *testing.T) {
+	l, _ := newFakeDirectory(t)
+	store, err := NewSQLiteAccountStore(filepath.Join(t.TempDir(), "accounts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashPassword("bcrypt", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"eve", "bob"} {
+		if err = store.Create(&Account{Username: username, Password: hash, Role: RoleParticipant}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accounts := NewAccounts(store)
+	accounts.LDAP = l
+
+	//Users that are not staff in the directory log in with their local account
+	acct, err := accounts.Challenge(&AuthenticateRequest{Username: "eve", Password: "local"})
+	if err != nil || acct.Role != RoleParticipant {
+		t.Errorf("eve: got %v %v, want %v", acct, err, RoleParticipant)
+	}
+
+	//A wrong password of a staff user is not retried against the local account
+	if _, err = accounts.Challenge(&AuthenticateRequest{Username: "bob", Password: "local"}); err != errInvalidCredentials {
+		t.Errorf("bob: got %v, want %v", err, errInvalidCredentials)
+	}
+}
+
+func TestLDAPRole(t *testing.T) {
+	l, _ := newFakeDirectory(t)
+
+	tests := []struct {
+		groups []string
+		role   Role
+	}{
+		{[]string{"cn=admins,dc=lab", "cn=staff,dc=lab"}, RoleAdmin},
+		{[]string{"cn=staff,dc=lab", "cn=admins,dc=lab"}, RoleAdmin},
+		{[]string{"CN=Staff,DC=lab"}, RoleResearcher},
+		{[]string{"cn=students,dc=lab"}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if role := l.role(test.groups); role != test.role {
+			t.Errorf("%v: got %q, want %q", test.groups, role, test.role)
+		}
+	}
+}
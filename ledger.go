@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteLedgerSchema = `CREATE TABLE IF NOT EXISTS sessions (
+	username        TEXT NOT NULL,
+	num             INTEGER NOT NULL,
+	token_id        TEXT NOT NULL,
+	session_time    TEXT NOT NULL,
+	started_at      TEXT NOT NULL,
+	last_task_at    TEXT NOT NULL DEFAULT '',
+	completed_at    TEXT NOT NULL DEFAULT '',
+	tasks           INTEGER NOT NULL DEFAULT 0,
+	task_quota      INTEGER NOT NULL DEFAULT 0,
+	completed_tasks TEXT NOT NULL DEFAULT '[]',
+	resumed         INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (username, num)
+)`
+
+//sqliteLedgerGroupsSchema keeps the group of the task order matrix each participant is assigned to.
+const sqliteLedgerGroupsSchema = `CREATE TABLE IF NOT EXISTS task_groups (
+	username    TEXT PRIMARY KEY,
+	grp         INTEGER NOT NULL,
+	assigned_at TEXT NOT NULL
+)`
+
+/*
+sqliteLedgerRecord inserts or updates the row of a session. A session number that was abandoned
+without completing a task is handed out again by Start, so its row is taken over by the new token. The
+tasks only ever go up so a late update from a concurrent request can't undo a newer one.
+*/
+const sqliteLedgerRecord = `INSERT INTO sessions (username, num, token_id, session_time, started_at,
+	last_task_at, completed_at, tasks, task_quota, completed_tasks, resumed)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (username, num) DO UPDATE SET
+	token_id = excluded.token_id,
+	session_time = excluded.session_time,
+	started_at = CASE WHEN sessions.tasks = 0 AND excluded.tasks = 0 THEN excluded.started_at ELSE sessions.started_at END,
+	last_task_at = CASE WHEN excluded.tasks >= sessions.tasks THEN excluded.last_task_at ELSE sessions.last_task_at END,
+	completed_at = CASE WHEN sessions.completed_at = '' THEN excluded.completed_at ELSE sessions.completed_at END,
+	completed_tasks = CASE WHEN excluded.tasks >= sessions.tasks THEN excluded.completed_tasks ELSE sessions.completed_tasks END,
+	tasks = MAX(sessions.tasks, excluded.tasks),
+	task_quota = excluded.task_quota,
+	resumed = MAX(sessions.resumed, excluded.resumed)`
+
+/*
+LedgerSession is a session of a participant as recorded in the SessionLedger.
+*/
+type LedgerSession struct {
+	Num            int
+	TokenID        string
+	SessionTime    time.Time
+	Started        time.Time
+	LastTask       *time.Time
+	Completed      *time.Time
+	Tasks          int
+	TaskQuota      int
+	CompletedTasks []CompletedTask
+	Resumed        int
+}
+
+/*
+SessionLedger keeps every session participants start and complete in a SQLite database. Unlike
+the session store it is never expired, so it is what session numbers are counted from.
+*/
+type SessionLedger struct {
+	db *sql.DB
+}
+
+/*
+NewSessionLedger opens the SQLite database at path, creating it and the sessions table if needed.
+*/
+func NewSessionLedger(path string) (*SessionLedger, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	for _, schema := range []string{sqliteLedgerSchema, sqliteLedgerGroupsSchema} {
+		if _, err = db.Exec(schema); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &SessionLedger{db: db}, nil
+}
+
+/*
+Start numbers the next session of the participant and creates its token in store. The number is
+allocated and recorded in one transaction, and the ledger only has the one connection, so
+concurrent logins never get the same number. Sessions are numbered after the last one that
+completed a task, or after floor when the session store counted more. The number of a session that
+was abandoned before completing a task is handed out again once its token is gone, numbers whose
+token is still live are skipped.
+*/
+func (l *SessionLedger) Start(acct *Account, floor int, store SessionStore) (*AuthToken, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var num int
+	if err = tx.QueryRow(`SELECT COALESCE(MAX(num), 0) FROM sessions WHERE username = ? AND tasks > 0`,
+		acct.Username).Scan(&num); err != nil {
+		return nil, err
+	}
+	if floor > num {
+		num = floor
+	}
+	num++
+
+	rows, err := tx.Query(`SELECT num, token_id FROM sessions WHERE username = ? AND num >= ? ORDER BY num`,
+		acct.Username, num)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[int]string)
+	for rows.Next() {
+		var n int
+		var id string
+		if err = rows.Scan(&n, &id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		held[n] = id
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for id, ok := held[num]; ok; id, ok = held[num] {
+		if _, err = store.Get(id); err == errNoToken {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		num++
+	}
+
+	token, err := store.Create(acct, num)
+	if err != nil {
+		return nil, err
+	}
+	if err = recordSession(tx, token, false); err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		//A session that is not in the ledger would hand out its number again
+		store.Expire(token)
+		return nil, err
+	}
+	return token, nil
+}
+
+/*
+Group returns the group of the task order matrix the user is assigned to. Participants are assigned
+to the groups in turn the first time they are asked for, so each group gets as many participants.
+*/
+func (l *SessionLedger) Group(username string, groups int) (int, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var group int
+	err = tx.QueryRow(`SELECT grp FROM task_groups WHERE username = ?`, username).Scan(&group)
+	if err == nil {
+		return group % groups, nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var assigned int
+	if err = tx.QueryRow(`SELECT COUNT(*) FROM task_groups`).Scan(&assigned); err != nil {
+		return 0, err
+	}
+	group = assigned % groups
+	if _, err = tx.Exec(`INSERT INTO task_groups (username, grp, assigned_at) VALUES (?, ?, ?)`,
+		username, group, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return 0, err
+	}
+	return group, tx.Commit()
+}
+
+/*
+Record stores the current state of the session of the token, marking it completed when its quota
+of tasks has been reached. A token that resumed another session no longer owns the row of the
+session number it started with, that row is removed when no task was completed in it. Only the
+sessions of participants are recorded, not those of demo accounts or lab staff.
+*/
+func (l *SessionLedger) Record(token *AuthToken, completed bool) error {
+	if !token.Participant() {
+		return nil
+	}
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = recordSession(tx, token, completed); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+recordSession writes the row of the session of the token within tx, see Record.
+*/
+func recordSession(tx *sql.Tx, token *AuthToken, completed bool) error {
+	completedTasks := token.CompletedTasks()
+	b, err := json.Marshal(completedTasks)
+	if err != nil {
+		return err
+	}
+	var lastTask, completedAt *time.Time
+	if len(completedTasks) > 0 {
+		lastTask = &completedTasks[len(completedTasks)-1].Time
+	}
+	if completed {
+		now := time.Now().Truncate(time.Second)
+		completedAt = &now
+	}
+
+	if _, err = tx.Exec(`DELETE FROM sessions WHERE username = ? AND token_id = ? AND num <> ? AND tasks = 0`,
+		token.User, token.ID, token.Num); err != nil {
+		return err
+	}
+	_, err = tx.Exec(sqliteLedgerRecord, token.User, token.Num, token.ID,
+		formatStoredTime(&token.SessionTime), formatStoredTime(&token.Created),
+		formatStoredTime(lastTask), formatStoredTime(completedAt), token.Tasks, token.TaskQuota,
+		string(b), token.Resumed)
+	return err
+}
+
+/*
+List returns the sessions of the user in the order they were started.
+*/
+func (l *SessionLedger) List(username string) ([]LedgerSession, error) {
+	rows, err := l.db.Query(`SELECT num, token_id, session_time, started_at, last_task_at,
+		completed_at, tasks, task_quota, completed_tasks, resumed FROM sessions
+		WHERE username = ? ORDER BY num`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []LedgerSession{}
+	for rows.Next() {
+		var s LedgerSession
+		var sessionTime, started, lastTask, completed, completedTasks string
+		if err := rows.Scan(&s.Num, &s.TokenID, &sessionTime, &started, &lastTask, &completed,
+			&s.Tasks, &s.TaskQuota, &completedTasks, &s.Resumed); err != nil {
+			return nil, err
+		}
+		if s.SessionTime, err = time.Parse(time.RFC3339, sessionTime); err != nil {
+			return nil, err
+		}
+		if s.Started, err = time.Parse(time.RFC3339, started); err != nil {
+			return nil, err
+		}
+		if s.LastTask, err = parseStoredTime(lastTask); err != nil {
+			return nil, err
+		}
+		if s.Completed, err = parseStoredTime(completed); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(completedTasks), &s.CompletedTasks); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+/*
+getAccountSessions lists the sessions the participant has started, including those that were
+never completed.
+*/
+func getAccountSessions(c *gin.Context) {
+	list, err := ledger.List(c.Param("username"))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	c.JSON(200, list)
+}
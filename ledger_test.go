@@ -0,0 +1,165 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//newTestLedger opens a SessionLedger in the temporary folder of the test.
+func newTestLedger(t *testing.T) *SessionLedger {
+	l, err := NewSessionLedger(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.db.Close() })
+	return l
+}
+
+//startLedgerSession starts the next session of the account, failing the test if it can not.
+func startLedgerSession(t *testing.T, l *SessionLedger, acct *Account, floor int, store SessionStore) *AuthToken {
+	token, err := l.Start(acct, floor, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestSessionLedgerStart(t *testing.T) {
+	setTokenExpiration(t, time.Hour)
+	l := newTestLedger(t)
+	store := NewMemorySessionStore()
+	acct := &Account{Username: "alice", Role: RoleParticipant, Tasks: 4}
+
+	first := startLedgerSession(t, l, acct, 0, store)
+	if first.Num != 1 {
+		t.Fatalf("first session is %v, want 1", first.Num)
+	}
+
+	//A live session that has not completed a task keeps its number
+	second := startLedgerSession(t, l, acct, 0, store)
+	if second.Num != 2 {
+		t.Errorf("session started next to a live one is %v, want 2", second.Num)
+	}
+
+	//The number of an abandoned session is handed out again once its token is gone
+	store.Expire(first)
+	if again := startLedgerSession(t, l, acct, 0, store); again.Num != 1 {
+		t.Errorf("session started after the first was abandoned is %v, want 1", again.Num)
+	}
+
+	//Once a task is completed the number is used up
+	if _, err := store.CompleteTask(second, "Arithmetic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(second, false); err != nil {
+		t.Fatal(err)
+	}
+	store.Expire(second)
+	if next := startLedgerSession(t, l, acct, 0, store); next.Num != 3 {
+		t.Errorf("session started after a completed task is %v, want 3", next.Num)
+	}
+
+	//Sessions counted by the store before the ledger was kept are not handed out again
+	if next := startLedgerSession(t, l, acct, 7, store); next.Num != 8 {
+		t.Errorf("session started after 7 counted sessions is %v, want 8", next.Num)
+	}
+
+	list, err := l.List(acct.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nums []int
+	for _, s := range list {
+		nums = append(nums, s.Num)
+	}
+	if want := []int{1, 2, 3, 8}; !reflect.DeepEqual(nums, want) {
+		t.Errorf("ledger has sessions %v, want %v", nums, want)
+	}
+}
+
+/*
+TestSessionLedgerStartConcurrent logs the participant in many times at once, every session must get
+its own number and its own row in the ledger.
+*/
+func TestSessionLedgerStartConcurrent(t *testing.T) {
+	setTokenExpiration(t, time.Hour)
+	l := newTestLedger(t)
+	store := NewMemorySessionStore()
+	acct := &Account{Username: "bob", Role: RoleParticipant, Tasks: 4}
+
+	const logins = 16
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	tokens := make(map[int]string)
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := l.Start(acct, 0, store)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if id, dup := tokens[token.Num]; dup {
+				t.Errorf("session %v was given to %v and %v", token.Num, id, token.ID)
+			}
+			tokens[token.Num] = token.ID
+		}()
+	}
+	wg.Wait()
+
+	list, err := l.List(acct.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != logins {
+		t.Fatalf("ledger has %v sessions, want %v", len(list), logins)
+	}
+	for i, s := range list {
+		if s.Num != i+1 || s.TokenID != tokens[s.Num] {
+			t.Errorf("ledger has session %v of token %v, want %v of %v", s.Num, s.TokenID, i+1, tokens[i+1])
+		}
+	}
+}
+
+func TestSessionLedgerGroup(t *testing.T) {
+	l := newTestLedger(t)
+
+	//Participants are assigned to the groups in turn so each gets as many
+	counts := make([]int, 4)
+	for i := 0; i < 12; i++ {
+		group, err := l.Group("participant"+strconv.Itoa(i), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group != i%4 {
+			t.Errorf("participant %v was assigned to group %v, want %v", i, group, i%4)
+		}
+		counts[group]++
+	}
+	if want := []int{3, 3, 3, 3}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("groups have %v participants, want %v", counts, want)
+	}
+
+	//The assignment is kept, and wraps around when there are fewer groups than when it was made
+	for _, test := range []struct {
+		groups, want int
+	}{{4, 3}, {4, 3}, {2, 1}, {3, 0}} {
+		group, err := l.Group("participant3", test.groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group != test.want {
+			t.Errorf("participant3 is in group %v of %v, want %v", group, test.groups, test.want)
+		}
+	}
+	if group, err := l.Group("participant12", 4); err != nil || group != 0 {
+		t.Errorf("next participant was assigned to group %v %v, want 0", group, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+/*
+The lockout scopes track failed logins per username and per client IP. A client IP is allowed more
+failures than a username as several participants may share a lab computer or network.
+*/
+const (
+	lockoutUser = "user"
+	lockoutIP   = "ip"
+)
+
+func failKey(scope, id string) string {
+	return "login:fail:" + scope + ":" + id
+}
+
+func lockKey(scope, id string) string {
+	return "login:lock:" + scope + ":" + id
+}
+
+/*
+loginLockout returns how long the username or client IP is still locked out for. A zero duration
+means the login attempt can go ahead. An empty username only checks the client IP.
+*/
+func loginLockout(username, ip string) (time.Duration, error) {
+	keys := []string{lockKey(lockoutIP, ip)}
+	if username != "" {
+		keys = append(keys, lockKey(lockoutUser, username))
+	}
+
+	var wait time.Duration
+	for _, key := range keys {
+		d, err := sessions.TTL(key)
+		if err != nil {
+			return 0, err
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+/*
+recordLoginFailure counts a failed login against the username and client IP. Once a scope has
+reached its allowed number of failures it is locked out, doubling the lockout with every further
+failure up to lockoutMax. The failures are forgotten once lockoutMax passes without a new one. The
+returned duration is how long the login is now locked out for. An empty username only counts the
+failure against the client IP.
+*/
+func recordLoginFailure(username, ip string) (time.Duration, error) {
+	scopes := []struct {
+		scope, id string
+		allowed   int64
+	}{
+		{lockoutUser, username, loginAttempts},
+		{lockoutIP, ip, loginIPAttempts},
+	}
+
+	var wait time.Duration
+	for _, s := range scopes {
+		if s.id == "" {
+			continue
+		}
+		count, err := sessions.Incr(failKey(s.scope, s.id), lockoutMax)
+		if err != nil {
+			return 0, err
+		}
+		if count < s.allowed {
+			continue
+		}
+
+		d := lockoutMax
+		if shift := uint(count - s.allowed); shift < 32 && lockoutBase<<shift < lockoutMax {
+			d = lockoutBase << shift
+		}
+		if err = sessions.SetValue(lockKey(s.scope, s.id), strconv.FormatInt(count, 10), d); err != nil {
+			return 0, err
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+/*
+clearLockout removes the failed login count and any lockout for the scope.
+*/
+func clearLockout(scope, id string) error {
+	return sessions.DeleteValues(failKey(scope, id), lockKey(scope, id))
+}
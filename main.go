@@ -7,6 +7,7 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -22,72 +23,329 @@ import (
 )
 
 var (
-	errInvalidFormat = errors.New("invalid account format")
-	errNoToken       = errors.New("no token found")
-
-	accountPath     string
-	httpAddr        string
-	httpsAddr       string
-	keyPath         string
-	certPath        string
-	outputPath      string
-	accountCheck    time.Duration
-	tokenExpiration time.Duration
-	rpool           *pool.Pool
-	sessCountMonths = 12
-
-	accounts = NewAccounts()
+	errInvalidFormat      = errors.New("invalid account format")
+	errInvalidUsername    = errors.New("username must not be empty or contain whitespace, control characters or :")
+	errNoToken            = errors.New("no token found")
+	errInvalidRole        = errors.New("invalid account role")
+	errUnknownField       = errors.New("unknown account field")
+	errAccountExists      = errors.New("account already exists")
+	errAccountNotFound    = errors.New("account not found")
+	errAccountConflict    = errors.New("account was changed by another request, try again")
+	errInvalidCredentials = errors.New("invalid username or password")
+	errUnknownStore       = errors.New("unknown account store")
+	errUnknownSessions    = errors.New("unknown session store")
+	errInvalidLDAPURL     = errors.New("ldap url must use the ldap or ldaps scheme")
+	errInvalidCode        = errors.New("invalid enrollment code")
+	errAccountDisabled    = errors.New("account is disabled")
+	errAccessNotStarted   = errors.New("study access has not started")
+	errAccessEnded        = errors.New("study access has ended")
+	errInvalidCookie      = errors.New("invalid cookie signature")
+	errLockedOut          = errors.New("too many failed logins, try again later")
+	errInvalidChallenge   = errors.New("two-factor login expired, log in again")
+	errTOTPEnabled        = errors.New("two-factor authentication is already enabled")
+	errInvalidTaskQuota   = errors.New("task quota must be a positive number or unlimited")
+	errNoTaskName         = errors.New("results must have a Task")
+	errDuplicateTask      = errors.New("results of this task were already submitted in this session")
+	errSessionStarted     = errors.New("tasks have already been completed in this session")
+	errNoResumable        = errors.New("no unfinished session to resume")
+	errSessionConflict    = errors.New("session was changed by another request, try again")
+	errFixedExpiry        = errors.New("sessions have a fixed expiry and cannot be extended")
+	errUnexpectedReply    = errors.New("unexpected reply from redis")
+	errInvalidTaskOrder   = errors.New("task orders must number the tasks of -tasks from 1, each at most once")
+	errTaskOutOfOrder     = errors.New("results of this task were submitted before the task that comes first in the session")
+
+	//accessReasons are the values of the access query parameter of the login page.
+	accessReasons = map[error]string{
+		errAccountDisabled:  "disabled",
+		errAccessNotStarted: "notstarted",
+		errAccessEnded:      "ended",
+	}
+	//accessMessages are shown on the login page for the access query parameter.
+	accessMessages = map[string]string{
+		"disabled":   "Your account has been disabled. Please contact the study team.",
+		"notstarted": "Your study access has not started yet. Please try again later.",
+		"ended":      "Your study access has ended. Thank you for taking part.",
+	}
+
+	accountPath         string
+	accountStore        string
+	sessionStore        string
+	taskQuota           int
+	taskNames           []string
+	rejectDuplicates    bool
+	taskOrdersPath      string
+	enforceTaskOrder    bool
+	taskOrders          [][][]string
+	accountsDB          string
+	ledgerPath          string
+	ldapURL             string
+	ldapStartTLS        bool
+	ldapBindDN          string
+	ldapBaseDN          string
+	ldapUserFilter      string
+	ldapGroupAttr       string
+	ldapAdminGroup      string
+	ldapResearcherGroup string
+	oidcIssuer          string
+	oidcClientID        string
+	oidcRedirectURL     string
+	oidcUsernameClaim   string
+	oidcGroupsClaim     string
+	oidcAdminGroup      string
+	oidcResearcherGroup string
+	httpAddr            string
+	httpsAddr           string
+	keyPath             string
+	certPath            string
+	outputPath          string
+	demoResultsPath     string
+	accountCheck        time.Duration
+	tokenExpiration     time.Duration
+	tokenMaxLifetime    time.Duration
+	resumeWindow        time.Duration
+	slidingExpiry       bool
+	trustProxy          bool
+	rpool               *pool.Pool
+	sessCountMonths     = 12
+	loginAttempts       int64
+	loginIPAttempts     int64
+	lockoutBase         time.Duration
+	lockoutMax          time.Duration
+	auditPath           string
+	auditMaxSize        int64
+	auditKeep           int
+	cookieSecretGrace   time.Duration
+
+	accounts     *Accounts
+	sessions     SessionStore
+	ledger       *SessionLedger
+	oidcProvider *OIDCProvider
+	auditLog     *AuditLog
+	cookieSigner *CookieSigner
 )
 
-func init() {
+/*
+parseFlags defines and parses the flags of the server. It is called by main rather than init so
+the tests of the package can be run with the flags of go test.
+*/
+func parseFlags() {
 	flag.StringVar(&httpAddr, "http", "localhost:8080", "defines the IP and port for the web server to bind http to")
 	flag.StringVar(&httpsAddr, "https", "", "defines the IP and Port for the web server to bind https to")
 	flag.StringVar(&keyPath, "key", "", "the path to the private key used for https")
 	flag.StringVar(&certPath, "cert", "", "the path to the public key used for https")
 	flag.StringVar(&outputPath, "results", "results", "folder path to create csv files in")
+	flag.StringVar(&demoResultsPath, "demoResults", "", "folder path to create csv files of demo accounts in, they are discarded when empty")
 	flag.StringVar(&accountPath, "accounts", "accounts", "path to the accounts file")
+	flag.StringVar(&accountStore, "accountStore", "file", "where accounts are kept, one of file, redis or sqlite")
+	flag.StringVar(&sessionStore, "sessionStore", "redis", "where sessions are kept, one of redis or memory")
+	tQuota := flag.String("taskQuota", "4", "number of tasks a session ends after, or unlimited")
+	tNames := flag.String("tasks", "Arithmetic,Flanker,TrailsA,Remote Associates", "comma separated Task names of the results of the tasks in the battery")
+	flag.BoolVar(&rejectDuplicates, "rejectDuplicateTasks", false, "refuse the results of a task completed earlier in the session instead of keeping them apart")
+	flag.StringVar(&taskOrdersPath, "taskOrders", "", "path to the file of the orders the tasks are run in for each group of participants and session, the Latin square of the default battery when empty")
+	flag.BoolVar(&enforceTaskOrder, "enforceTaskOrder", false, "refuse the results of a task completed before the tasks that come first in the session instead of marking them")
+	flag.StringVar(&accountsDB, "accountsDB", "accounts.db", "path to the SQLite database used by the sqlite account store")
+	flag.StringVar(&ledgerPath, "sessionLedger", "sessions.db", "path to the SQLite database every session participants start and complete is recorded in")
+	flag.StringVar(&ldapURL, "ldap", "", "url of the LDAP server lab staff log in with, ldap://host:port or ldaps://host:port")
+	flag.BoolVar(&ldapStartTLS, "ldapStartTLS", false, "upgrade ldap:// connections with StartTLS")
+	flag.StringVar(&ldapBindDN, "ldapBindDN", "", "DN of the service account used to search for users, the password is read from LDAP_BIND_PASSWORD")
+	flag.StringVar(&ldapBaseDN, "ldapBaseDN", "", "DN to search for users under")
+	flag.StringVar(&ldapUserFilter, "ldapUserFilter", "(uid=%s)", "filter to find a user, %s is replaced with the username")
+	flag.StringVar(&ldapGroupAttr, "ldapGroupAttr", "memberOf", "attribute of the user entry listing its groups")
+	flag.StringVar(&ldapAdminGroup, "ldapAdminGroup", "", "DN of the group whose members get the admin role")
+	flag.StringVar(&oidcIssuer, "oidcIssuer", "", "issuer url of the OpenID Connect provider staff can sign in with, the client secret is read from OIDC_CLIENT_SECRET")
+	flag.StringVar(&oidcClientID, "oidcClientID", "", "client id registered with the OpenID Connect provider")
+	flag.StringVar(&oidcRedirectURL, "oidcRedirectURL", "", "redirect url registered with the OpenID Connect provider, https://host/login/oidc/callback")
+	flag.StringVar(&oidcUsernameClaim, "oidcUsernameClaim", "preferred_username", "ID token claim used as the username")
+	flag.StringVar(&oidcGroupsClaim, "oidcGroupsClaim", "groups", "ID token claim listing the groups of the user")
+	flag.StringVar(&oidcAdminGroup, "oidcAdminGroup", "", "group whose members get the admin role")
+	flag.StringVar(&oidcResearcherGroup, "oidcResearcherGroup", "", "group whose members get the researcher role")
+	flag.StringVar(&auditPath, "audit", "audit.log", "path to the audit log of logins, logouts and admin actions")
+	flag.IntVar(&auditKeep, "auditKeep", 10, "number of rotated audit logs to keep")
+	flag.BoolVar(&trustProxy, "trustProxy", false, "take the client IP from the X-Real-Ip and X-Forwarded-For headers, only set behind a reverse proxy that sets them")
+	flag.BoolVar(&slidingExpiry, "slidingExpiry", false, "extend tokens by tokenExpiry on every request, up to tokenMaxLifetime")
+	flag.StringVar(&ldapResearcherGroup, "ldapResearcherGroup", "", "DN of the group whose members get the researcher role")
 
 	acs := flag.Int64("checkAccount", 30, "time in seconds to check the accounts file")
 	tExp := flag.Int64("tokenExpiry", 1800, "maximum time a token is valid")
+	tMax := flag.Int64("tokenMaxLifetime", 7200, "time in seconds after login that a token can not be extended past")
+	rWin := flag.Int64("resumeWindow", 86400, "time in seconds after its last task that an unfinished session can be resumed, 0 to turn off")
+	flag.Int64Var(&loginAttempts, "loginAttempts", 5, "failed logins allowed for a username before it is locked out")
+	flag.Int64Var(&loginIPAttempts, "loginIPAttempts", 20, "failed logins allowed from a client IP before it is locked out")
+	lBase := flag.Int64("lockoutBase", 60, "time in seconds of the first lockout, doubled on every further failure")
+	lMax := flag.Int64("lockoutMax", 3600, "maximum time in seconds of a lockout")
+	aSize := flag.Int64("auditMaxSize", 10, "size in MB the audit log is rotated at")
+	cGrace := flag.Int64("cookieSecretGrace", 86400, "time in seconds cookies signed with COOKIE_SECRET_PREVIOUS are still accepted after a restart")
 
 	flag.Parse()
 
 	//Create the needed Duration objects from falgs
 	tokenExpiration, _ = time.ParseDuration(strconv.FormatInt(*tExp, 10) + "s")
+	tokenMaxLifetime, _ = time.ParseDuration(strconv.FormatInt(*tMax, 10) + "s")
+	resumeWindow, _ = time.ParseDuration(strconv.FormatInt(*rWin, 10) + "s")
+	if tokenMaxLifetime < tokenExpiration {
+		tokenMaxLifetime = tokenExpiration
+	}
 	accountCheck, _ = time.ParseDuration(strconv.FormatInt(*acs, 10) + "s")
+	lockoutBase, _ = time.ParseDuration(strconv.FormatInt(*lBase, 10) + "s")
+	lockoutMax, _ = time.ParseDuration(strconv.FormatInt(*lMax, 10) + "s")
+	auditMaxSize = *aSize << 20
+	cookieSecretGrace, _ = time.ParseDuration(strconv.FormatInt(*cGrace, 10) + "s")
+
+	taskNames = splitList(*tNames)
+	var err error
+	if taskQuota, err = parseTaskQuota(*tQuota); err != nil {
+		log.Fatalf("invalid -taskQuota %q, %v", *tQuota, err)
+	}
 }
 
 func main() {
+	parseFlags()
+
+	if flag.Arg(0) == "hash-password" {
+		if err := hashPasswordCommand(flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Kill, os.Interrupt)
 
-	purl, err := url.Parse(os.Getenv("REDIS_PORT"))
+	//Redis is only needed by the redis stores and enrollment codes
+	var err error
+	if os.Getenv("REDIS_PORT") != "" {
+		purl, err := url.Parse(os.Getenv("REDIS_PORT"))
+		if err != nil {
+			log.Fatalf("REDIS_PORT wasn't a valid url to the redis instance, %v '%v'", err, os.Getenv("REDIS_PORT"))
+		}
+		rpool, err = pool.NewPool(purl.Scheme, purl.Host, 5)
+		if err != nil {
+			log.Fatalf("AbortWithErrored to connect to redis, %v", err)
+		}
+	} else if sessionStore == "redis" || accountStore == "redis" {
+		log.Fatalln("REDIS_PORT must be set to keep sessions or accounts in redis, use -sessionStore memory to run without redis")
+	}
+
+	sessions, err = newSessionStore()
+	if err != nil {
+		log.Fatalf("failed to open the %v session store, %v", sessionStore, err)
+	}
+	ledger, err = NewSessionLedger(ledgerPath)
+	if err != nil {
+		log.Fatalf("failed to open the session ledger, %v", err)
+	}
+	taskOrders, err = loadTaskOrders(taskOrdersPath)
 	if err != nil {
-		log.Fatalf("REDIS_PORT wasn't a valid url to the redis instance, %v '%v'", err, os.Getenv("REDIS_PORT"))
+		log.Fatalf("failed to load the task orders, %v", err)
 	}
-	rpool, err = pool.NewPool(purl.Scheme, purl.Host, 5)
+
+	//Start up the account store and the background services it needs
+	store, err := newAccountStore()
 	if err != nil {
-		log.Fatalf("AbortWithErrored to connect to redis, %v", err)
+		log.Fatalf("failed to open the %v account store, %v", accountStore, err)
 	}
+	accounts = NewAccounts(store)
 
-	//Start up the background services that keep the application in check
-	go accounts.AccountsService()
+	if ldapURL != "" {
+		accounts.LDAP, err = newLDAPAuthenticator()
+		if err != nil {
+			log.Fatalf("failed to configure ldap, %v", err)
+		}
+	}
+
+	if oidcIssuer != "" {
+		oidcProvider = NewOIDCProvider(oidcIssuer, oidcClientID, oidcRedirectURL)
+		oidcProvider.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+		oidcProvider.UsernameClaim = oidcUsernameClaim
+		oidcProvider.GroupsClaim = oidcGroupsClaim
+		oidcProvider.AdminGroup = oidcAdminGroup
+		oidcProvider.ResearcherGroup = oidcResearcherGroup
+	}
+
+	if flag.Arg(0) == "import-accounts" {
+		if err := importAccountsCommand(flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	//Earlier versions never recorded the results of the activebrain account
+	if acct, err := accounts.Get("activebrain"); err == nil && !acct.Demo {
+		log.Println("the activebrain account is not a demo account and its results will be recorded, add demo=true to it to keep them out of the data")
+	} else if err != nil && err != errAccountNotFound {
+		log.Printf("failed to check the activebrain account, %v", err)
+	}
+
+	auditLog, err = NewAuditLog(auditPath, auditMaxSize, auditKeep)
+	if err != nil {
+		log.Fatalf("failed to open the audit log, %v", err)
+	}
+
+	if os.Getenv("COOKIE_SECRET") == "" {
+		log.Println("COOKIE_SECRET is not set, sessions will end when the server restarts")
+	}
+	cookieSigner, err = NewCookieSigner(os.Getenv("COOKIE_SECRET"), os.Getenv("COOKIE_SECRET_PREVIOUS"), cookieSecretGrace)
+	if err != nil {
+		log.Fatalf("failed to create the cookie secret, %v", err)
+	}
 
 	fileServer := http.FileServer(http.Dir("web/"))
 	gin.SetMode(gin.ReleaseMode)
 
 	//Setup Gin
 	r := gin.Default()
-	r.Use(authenticated())
+	//Any client can send the forwarding headers, they can only be trusted behind a proxy that sets them
+	r.ForwardedByClientIP = trustProxy
+	r.Use(csrfProtect(), authenticated())
 	r.LoadHTMLGlob("*.tmpl")
 
 	r.POST("/results", postResults)
 	r.GET("/login", getLogin)
 	r.POST("/login", postLogin)
-	r.GET("/logout", getLogout)
+	r.POST("/login/token", postLoginToken)
+	r.POST("/login/token/totp", postLoginTokenTOTP)
+	r.GET("/login/totp", getLoginTOTP)
+	r.POST("/login/totp", postLoginTOTP)
+	if rpool != nil {
+		r.GET("/login/code/:code", getLoginCode)
+		r.POST("/login/code/:code", postLoginCode)
+	}
+	if oidcProvider != nil {
+		r.GET("/login/oidc", getOIDCLogin)
+		r.GET("/login/oidc/callback", getOIDCCallback)
+	}
+	r.POST("/logout", postLogout)
 	r.GET("/session", getSession)
+	r.POST("/session/refresh", postSessionRefresh)
+	r.POST("/session/resume", postSessionResume)
 	r.GET("/subject", getSubject)
+	r.POST("/account/totp", postTOTPSetup)
+	r.POST("/account/totp/confirm", postTOTPConfirm)
+	r.DELETE("/account/totp", deleteTOTP)
+
+	admin := r.Group("/admin", requireRole(RoleAdmin), auditAdmin())
+	admin.GET("/accounts", getAccounts)
+	admin.POST("/accounts", postAccount)
+	admin.POST("/accounts/:username/disable", postAccountDisable)
+	admin.POST("/accounts/:username/enable", postAccountEnable)
+	admin.POST("/accounts/:username/password", postAccountPassword)
+	admin.POST("/accounts/:username/access", postAccountAccess)
+	admin.POST("/accounts/:username/tasks", postAccountTasks)
+	admin.GET("/accounts/:username/sessions", getAccountSessions)
+	admin.DELETE("/accounts/:username/totp", deleteAccountTOTP)
+	admin.DELETE("/accounts/:username", deleteAccount)
+	admin.GET("/sessions", getActiveSessions)
+	admin.GET("/sessions/view", getActiveSessionsPage)
+	admin.POST("/sessions/:id/expire", postSessionExpire)
+	admin.POST("/sessions/:id/extend", postSessionExtend)
+	admin.DELETE("/lockouts/user/:username", deleteUserLockout)
+	admin.DELETE("/lockouts/ip/:ip", deleteIPLockout)
+	if rpool != nil {
+		admin.GET("/codes", getEnrollmentCodes)
+		admin.POST("/codes", postEnrollmentCode)
+		admin.DELETE("/codes/:code", deleteEnrollmentCode)
+	}
+	admin.GET("/audit", getAudit)
 
 	r.NoRoute(func(c *gin.Context) {
 		fileServer.ServeHTTP(c.Writer, c.Request)
@@ -113,10 +371,62 @@ func main() {
 	}
 
 	s := <-sig
-	rpool.Empty()
+	if rpool != nil {
+		rpool.Empty()
+	}
 	log.Println("OS Signal ", s)
 }
 
+/*
+newAccountStore creates the AccountStore selected by the accountStore flag. Services needed by the
+store are started in the background.
+*/
+func newAccountStore() (AccountStore, error) {
+	switch accountStore {
+	case "file":
+		store := NewFileAccountStore(accountPath)
+		go store.AccountsService()
+		return store, nil
+	case "redis":
+		return NewRedisAccountStore(), nil
+	case "sqlite":
+		return NewSQLiteAccountStore(accountsDB)
+	}
+	return nil, errUnknownStore
+}
+
+/*
+newSessionStore creates the SessionStore selected by the sessionStore flag.
+*/
+func newSessionStore() (SessionStore, error) {
+	switch sessionStore {
+	case "redis":
+		return NewRedisSessionStore()
+	case "memory":
+		return NewMemorySessionStore(), nil
+	}
+	return nil, errUnknownSessions
+}
+
+/*
+newLDAPAuthenticator creates the LDAPAuthenticator from the ldap flags.
+*/
+func newLDAPAuthenticator() (*LDAPAuthenticator, error) {
+	l, err := NewLDAPAuthenticator(ldapURL)
+	if err != nil {
+		return nil, err
+	}
+	l.StartTLS = ldapStartTLS
+	l.BindDN = ldapBindDN
+	l.BindPassword = os.Getenv("LDAP_BIND_PASSWORD")
+	l.BaseDN = ldapBaseDN
+	l.UserFilter = ldapUserFilter
+	l.GroupAttr = ldapGroupAttr
+	l.AdminGroup = ldapAdminGroup
+	l.ResearcherGroup = ldapResearcherGroup
+	return l, nil
+}
+
 /*
 httpRedirect is used to bounce http connections to https
 */
@@ -162,89 +472,341 @@ func httpsServer(handler http.Handler) {
 
 /*
 authenticated is a middleware to make sure access to the service is only granted to authenticated
-users.
+users. The token is taken from the Authorization header when it has a Bearer token and from the
+X-Auth-Token cookie otherwise. API clients get a JSON 401 instead of being sent to the login page.
 */
 func authenticated() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if strings.Contains(c.Request.URL.String(), "/login") {
 			return
 		}
-		cookie, err := c.Request.Cookie("X-Auth-Token")
+		signed, bearer := bearerToken(c)
+		if !bearer {
+			cookie, err := c.Request.Cookie(authCookie)
+			if err != nil {
+				unauthenticated(c)
+				return
+			}
+			signed = cookie.Value
+		}
+		//Check the signature before the value is used as a redis key
+		tid, resign, err := cookieSigner.Verify(signed)
 		if err != nil {
-			c.Redirect(303, "/login")
-			c.Abort()
+			unauthenticated(c)
 			return
 		}
-		tid := cookie.Value
 
-		token, err := GetAuthToken(tid)
+		token, err := sessions.Get(tid)
 		if err != nil {
-			c.Redirect(303, "/login")
-			c.Abort()
+			unauthenticated(c)
 			return
 		}
+		//Polling the session for the time left is not activity that keeps it alive. A token that was
+		//extended within the last minute is left alone so loading a page doesn't write it for every asset.
+		if slidingExpiry && !(c.Request.Method == "GET" && c.Request.URL.Path == "/session") &&
+			time.Until(token.Expiration) < tokenExpiration-time.Minute {
+			extended, err := extendToken(token)
+			if err == errNoToken {
+				unauthenticated(c)
+				return
+			} else if err != nil {
+				c.AbortWithError(500, err)
+				return
+			}
+			resign = resign || extended
+		}
+		if resign && !bearer {
+			setAuthCookie(c, token)
+		}
 
 		c.Set("token", token)
 	}
 }
 
+/*
+bearerToken returns the token of an Authorization: Bearer header. ok is false if the request has
+no such header.
+*/
+func bearerToken(c *gin.Context) (token string, ok bool) {
+	auth := c.Request.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+/*
+isAPIRequest reports whether the request comes from a script, app or the frontend's ajax calls
+rather than a browser navigating to a page. The admin routes are mostly used by scripts, so they
+are only treated as a page when the request asks for HTML.
+*/
+func isAPIRequest(c *gin.Context) bool {
+	if _, ok := bearerToken(c); ok {
+		return true
+	}
+	accept := c.Request.Header.Get("Accept")
+	if c.Request.Header.Get("X-Requested-With") == "XMLHttpRequest" || strings.Contains(accept, "application/json") {
+		return true
+	}
+	return strings.HasPrefix(c.Request.URL.Path, "/admin/") && !strings.Contains(accept, "text/html")
+}
+
+/*
+unauthenticated aborts a request without a valid token, with a JSON 401 for API requests and a
+redirect to the login page otherwise.
+*/
+func unauthenticated(c *gin.Context) {
+	if isAPIRequest(c) {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.JSON(401, gin.H{"error": "authentication required"})
+	} else {
+		c.Redirect(303, "/login")
+	}
+	c.Abort()
+}
+
+/*
+requireRole is a middleware that only lets the request through if the authenticated user has one
+of the provided roles. It must be used after authenticated.
+*/
+func requireRole(roles ...Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.MustGet("token").(*AuthToken)
+		for _, role := range roles {
+			if token.Role == role {
+				return
+			}
+		}
+		c.AbortWithStatus(403)
+	}
+}
+
 /*
 getLogin handles displaying the login screen.
 */
 func getLogin(c *gin.Context) {
-	if retry := c.Request.URL.Query().Get("retry"); retry != "" {
-		c.HTML(200, "login.tmpl", gin.H{
-			"message": "Please check credentials and try again.",
-		})
-	} else {
-		c.HTML(200, "login.tmpl", gin.H{})
+	props := gin.H{
+		"oidc": oidcProvider != nil,
+		"csrf": c.MustGet("csrf"),
+	}
+	q := c.Request.URL.Query()
+	if locked := q.Get("locked"); locked != "" {
+		mins, _ := strconv.Atoi(locked)
+		if mins < 1 {
+			mins = 1
+		}
+		props["message"] = fmt.Sprintf("Too many failed login attempts. Please wait %v minute(s) and try again.", mins)
+	} else if msg, ok := accessMessages[q.Get("access")]; ok {
+		props["message"] = msg
+	} else if q.Get("code") != "" {
+		props["message"] = "This login link is no longer valid. Please contact the study team for a new one."
+	} else if q.Get("oidc") == "denied" {
+		props["message"] = "Your institutional account does not have access to Activebrain."
+	} else if q.Get("oidc") != "" {
+		props["message"] = "Signing in with your institutional account failed, please try again."
+	} else if retry := q.Get("retry"); retry != "" {
+		props["message"] = "Please check credentials and try again."
 	}
+	c.HTML(200, "login.tmpl", props)
 }
 
 /*
-getLogout handles a logout request that forcefully expires the token and writes out
-pending results
+postLogout handles a logout request that forcefully expires the token and writes out
+pending results. It is a POST so it is covered by the CSRF check and another site can't log a
+participant out in the middle of a session.
 */
-func getLogout(c *gin.Context) {
+func postLogout(c *gin.Context) {
 	token := c.MustGet("token").(*AuthToken)
 
-	if err := ExpireToken(token); err != nil {
+	if err := sessions.Expire(token); err != nil {
 		c.AbortWithError(500, err)
 		return
 	}
+	audit(c, auditLogout, token.User, token.ID, "")
 	c.Redirect(303, "/login")
 }
 
 /*
-postLogin handles when a login attempt is made.
+postLogin handles when a login attempt is made from the login form. Accounts with two-factor
+authentication are sent on to the form asking for their code.
 */
 func postLogin(c *gin.Context) {
 	var req AuthenticateRequest
 
 	if err := binding.Form.Bind(c.Request, &req); err != nil {
 		c.AbortWithError(500, err)
+		return
 	}
 
-	if accounts.Challenge(&req) {
+	acct, wait, err := passwordLogin(c, &req)
+	if reason, ok := accessReasons[err]; ok {
+		c.Redirect(303, "/login?access="+reason)
+		return
+	} else if wait > 0 {
+		redirectLocked(c, wait)
+		return
+	} else if err == errInvalidCredentials {
+		c.Redirect(303, "/login?retry=1")
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
 
-		token, err := NewAuthToken(req.Username)
+	if acct.TOTPSecret != "" {
+		startTOTPLogin(c, acct)
+		return
+	}
+	token, err := startSession(c, acct, "password")
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	setAuthCookie(c, token)
+	c.Redirect(303, "/")
+}
+
+/*
+postLoginToken is the login endpoint for scripts and apps. It takes the credentials as JSON and
+returns the signed token to send in the Authorization header as a Bearer token. Accounts with
+two-factor authentication get a TOTPToken instead to send with their code to /login/token/totp.
+*/
+func postLoginToken(c *gin.Context) {
+	var req AuthenticateRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	acct, wait, err := passwordLogin(c, &req)
+	if _, ok := accessReasons[err]; ok {
+		c.JSON(403, gin.H{"error": err.Error()})
+		return
+	} else if wait > 0 {
+		lockedOut(c, wait)
+		return
+	} else if err == errInvalidCredentials {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	if acct.TOTPSecret != "" {
+		id, err := newTOTPChallenge(acct.Username)
 		if err != nil {
 			c.AbortWithError(500, err)
 			return
 		}
+		c.JSON(200, gin.H{"TOTPRequired": true, "TOTPToken": cookieSigner.Sign(id)})
+		return
+	}
+	token, err := startSession(c, acct, "token")
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	tokenResponse(c, token)
+}
+
+/*
+tokenResponse returns the signed token of a token login.
+*/
+func tokenResponse(c *gin.Context, token *AuthToken) {
+	c.JSON(200, gin.H{
+		"Token":      cookieSigner.Sign(token.ID),
+		"Expiration": token.Expiration,
+	})
+}
 
-		cookie := &http.Cookie{
-			Name:     "X-Auth-Token",
-			Value:    token.ID,
-			Path:     "/",
-			Expires:  token.Expiration,
-			HttpOnly: true,
+/*
+lockedOut tells an API client how long it is locked out for.
+*/
+func lockedOut(c *gin.Context, wait time.Duration) {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.FormatInt(secs, 10))
+	c.JSON(429, gin.H{"error": errLockedOut.Error(), "RetryAfter": secs})
+}
+
+/*
+passwordLogin checks the credentials and returns the account they belong to. Attempts are refused
+without checking the credentials while the username or client IP is locked out, in which case
+errLockedOut is returned with how long the lockout lasts. A wrong password returns
+errInvalidCredentials along with the lockout it caused, if any.
+*/
+func passwordLogin(c *gin.Context, req *AuthenticateRequest) (*Account, time.Duration, error) {
+	ip := c.ClientIP()
+	if wait, err := loginLockout(req.Username, ip); err != nil {
+		return nil, 0, err
+	} else if wait > 0 {
+		audit(c, auditLoginFailed, req.Username, "", "locked out")
+		return nil, wait, errLockedOut
+	}
+
+	acct, err := accounts.Challenge(req)
+	if _, ok := accessReasons[err]; ok {
+		audit(c, auditLoginFailed, req.Username, "", err.Error())
+		return nil, 0, err
+	} else if err == errInvalidCredentials {
+		audit(c, auditLoginFailed, req.Username, "", err.Error())
+		wait, err := recordLoginFailure(req.Username, ip)
+		if err != nil {
+			return nil, 0, err
 		}
-		http.SetCookie(c.Writer, cookie)
-		c.Redirect(303, "/")
-	} else {
-		c.Redirect(303, "/login?retry=1")
+		return nil, wait, errInvalidCredentials
+	} else if err != nil {
+		return nil, 0, err
 	}
+	return acct, 0, nil
+}
+
+/*
+createSession starts the next session of the account. The sessions of participants are numbered
+by the ledger, see SessionLedger.Start, the count kept by the session store is the floor for
+participants whose sessions were started before the ledger was kept.
+*/
+func createSession(acct *Account) (*AuthToken, error) {
+	count, err := sessions.SessionCount(acct.Username)
+	if err != nil {
+		return nil, err
+	}
+	if acct.Role != RoleParticipant || acct.Demo {
+		return sessions.Create(acct, count+1)
+	}
+
+	token, err := ledger.Start(acct, count, sessions)
+	if err != nil {
+		return nil, err
+	}
+	//Participants are assigned to a group of the task orders when they first log in
+	if _, err := ledger.Group(token.User, len(taskOrders)); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+/*
+startSession clears the failed logins of the account and creates a new AuthToken for it once it
+has fully logged in. method is recorded in the audit log.
+*/
+func startSession(c *gin.Context, acct *Account, method string) (*AuthToken, error) {
+	if err := clearLockout(lockoutUser, acct.Username); err != nil {
+		return nil, err
+	}
+	token, err := createSession(acct)
+	if err != nil {
+		return nil, err
+	}
+	audit(c, auditLogin, acct.Username, token.ID, method)
+	return token, nil
+}
+
+/*
+redirectLocked sends the user back to the login page with the lockout message.
+*/
+func redirectLocked(c *gin.Context, wait time.Duration) {
+	mins := int64((wait + time.Minute - 1) / time.Minute)
+	c.Redirect(303, "/login?locked="+strconv.FormatInt(mins, 10))
 }
 
 /*
@@ -253,31 +815,88 @@ a .csv file in the results folder.
 */
 func postResults(c *gin.Context) {
 	token := c.MustGet("token").(*AuthToken)
-	if token.User == "activebrain" {
-		return
-	}
 
 	var results Results
 	c.Bind(&results)
 
 	sr := NewStoredResults(results)
+	if sr.Task == "" {
+		c.JSON(400, gin.H{"error": errNoTaskName.Error()})
+		return
+	}
 
-	if err := sr.writeToDisk(token); err != nil {
+	order, group, err := sessionTaskOrder(token)
+	if err != nil {
 		c.AbortWithError(500, err)
 		return
 	}
+	sr.OrderGroup = group + 1
+	sr.OrderPosition = taskPosition(order, sr.Task)
+
+	//Demo sessions are never counted, their results are kept apart only if asked for.
+	if token.Demo {
+		if demoResultsPath != "" {
+			if err := sr.writeToDisk(demoResultsPath, token); err != nil {
+				c.AbortWithError(500, err)
+				return
+			}
+		}
+		return
+	}
 
-	if err := IncrementTasks(token); err != nil {
+	if expected := checkTaskOrder(token, order, sr.Task); expected != "" {
+		audit(c, auditOutOfOrder, token.User, token.ID, sr.Task+" submitted before "+expected)
+		if enforceTaskOrder {
+			c.JSON(409, gin.H{"error": errTaskOutOfOrder.Error(), "Task": sr.Task, "Expected": expected})
+			return
+		}
+		sr.OutOfOrder = true
+	}
+
+	res, err := sessions.CompleteTask(token, sr.Task)
+	if err == errNoToken {
+		unauthenticated(c)
+		return
+	} else if err == errSessionConflict {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		c.AbortWithError(500, err)
 		return
 	}
-	//Expire the token once 4 tasks have been executed.
-	if token.Tasks >= 4 {
-		if err := ExpireToken(token); err != nil {
+	if !res.Completed {
+		n := token.Duplicates[sr.Task]
+		audit(c, auditDuplicate, token.User, token.ID, sr.Task+" submitted "+strconv.Itoa(n+1)+" times")
+		if rejectDuplicates {
+			c.JSON(409, gin.H{"error": errDuplicateTask.Error(), "Task": sr.Task})
+			return
+		}
+		//Kept apart so the results of the first submission are not overwritten
+		sr.Duplicate = n
+	}
+
+	if err := sr.writeToDisk(outputPath, token); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if res.Completed {
+		if err := ledger.Record(token, res.Expired); err != nil {
 			c.AbortWithError(500, err)
 			return
 		}
 	}
+
+	//The store expired the token once its quota of tasks have been executed, otherwise keep the
+	//session so it can be resumed if it is interrupted.
+	if res.Expired {
+		if err := clearResumable(token.User); err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		audit(c, auditTokenExpired, token.User, token.ID, "completed "+strconv.Itoa(res.Tasks)+" tasks")
+	} else if err := saveResumable(token); err != nil {
+		c.AbortWithError(500, err)
+	}
 }
 
 /*
@@ -289,9 +908,84 @@ func getSession(c *gin.Context) {
 	props["ID"] = token.Num
 	props["UniqueID"] = token.ID
 	props["Expiration"] = token.Expiration
+	props["MaxExpiration"] = token.MaxExpiration()
+	props["Remaining"] = remainingSeconds(token)
+	props["SlidingExpiry"] = slidingExpiry
+	props["CSRFToken"] = c.MustGet("csrf")
+	props["Demo"] = token.Demo
+	props["Tasks"] = token.Tasks
+	//The quota and the tasks remaining are null for sessions without a quota.
+	props["TaskQuota"] = nil
+	props["TasksRemaining"] = nil
+	if token.TaskQuota != unlimitedTasks {
+		props["TaskQuota"] = token.TaskQuota
+		props["TasksRemaining"] = token.TasksRemaining()
+	}
+	props["CompletedTasks"] = token.CompletedTasks()
+	props["PendingTasks"] = token.PendingTasks()
+	props["DuplicateTasks"] = token.Duplicates
+	props["Resumed"] = token.Resumed
+	//The order the tasks of the session are run in and the group of participants it was picked for.
+	order, group, err := sessionTaskOrder(token)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	props["TaskOrder"] = order
+	props["OrderGroup"] = group + 1
+	//An unfinished session the participant can continue with POST /session/resume, or null.
+	props["Resumable"] = nil
+	resumable, err := getResumable(token)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	} else if resumable != nil {
+		props["Resumable"] = resumableProps(resumable)
+	}
 	c.JSON(200, props)
 }
 
+/*
+postSessionRefresh extends the session by tokenExpiration, up to its MaxExpiration, so a
+participant who is warned that it is about to expire can keep going. Sessions can only be
+extended with -slidingExpiry, otherwise they end tokenExpiration after login.
+*/
+func postSessionRefresh(c *gin.Context) {
+	token := c.MustGet("token").(*AuthToken)
+	if !slidingExpiry {
+		c.JSON(409, gin.H{"error": errFixedExpiry.Error()})
+		return
+	}
+
+	extended, err := extendToken(token)
+	if err == errNoToken {
+		unauthenticated(c)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if _, bearer := bearerToken(c); extended && !bearer {
+		setAuthCookie(c, token)
+	}
+	c.JSON(200, gin.H{
+		"Expiration":    token.Expiration,
+		"MaxExpiration": token.MaxExpiration(),
+		"Remaining":     remainingSeconds(token),
+	})
+}
+
+/*
+remainingSeconds returns the number of seconds left before the token expires.
+*/
+func remainingSeconds(token *AuthToken) int64 {
+	left := token.Expiration.Sub(time.Now())
+	if left < 0 {
+		return 0
+	}
+	return int64(left / time.Second)
+}
+
 /*
 getSubject returns the user/subject information
 */
@@ -299,5 +993,6 @@ func getSubject(c *gin.Context) {
 	token := c.MustGet("token").(*AuthToken)
 	props := make(map[string]interface{})
 	props["ID"] = token.User
+	props["Role"] = token.Role
 	c.JSON(200, props)
 }
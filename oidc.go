@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const oidcStateCookie = "X-OIDC-State"
+
+var (
+	errOIDCState     = errors.New("oidc state did not match")
+	errOIDCToken     = errors.New("invalid oidc id token")
+	errOIDCKey       = errors.New("no oidc signing key for id token")
+	errOIDCNoRole    = errors.New("oidc user is not a member of a staff group")
+	errOIDCDiscovery = errors.New("oidc discovery document is incomplete")
+)
+
+/*
+OIDCProvider signs staff in with an OpenID Connect provider using the authorization code flow with
+PKCE. The provider endpoints and signing keys are discovered from the issuer and cached.
+*/
+type OIDCProvider struct {
+	Issuer          string
+	ClientID        string
+	ClientSecret    string
+	RedirectURL     string
+	UsernameClaim   string
+	GroupsClaim     string
+	AdminGroup      string
+	ResearcherGroup string
+
+	//Client is used for all requests to the provider, tests can point it at a mock provider.
+	Client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//NewOIDCProvider creates a new OIDCProvider with the default claims.
+func NewOIDCProvider(issuer, clientID, redirectURL string) *OIDCProvider {
+	return &OIDCProvider{
+		Issuer:        strings.TrimSuffix(issuer, "/"),
+		ClientID:      clientID,
+		RedirectURL:   redirectURL,
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+/*
+getJSON fetches url from the provider and decodes the JSON response into v.
+*/
+func (p *OIDCProvider) getJSON(url string, v interface{}) error {
+	res, err := p.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("oidc provider returned %v for %v", res.Status, url)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+/*
+endpoints returns the discovery document, fetching it the first time it is needed.
+*/
+func (p *OIDCProvider) endpoints() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errOIDCDiscovery
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+/*
+key returns the signing key with the key id, fetching the keys again if the id is unknown so keys
+rotated by the provider are picked up.
+*/
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	d, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if key, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errOIDCKey
+}
+
+/*
+publicKey converts an RSA or P-256 JSON web key into a public key.
+*/
+func (k *oidcJWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			break
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported oidc key type %v", k.Kty)
+}
+
+/*
+AuthCodeURL returns the provider URL to send the user to along with the value of the state cookie.
+The cookie holds the state, nonce and PKCE verifier needed to finish the login in Exchange.
+*/
+func (p *OIDCProvider) AuthCodeURL() (string, string, error) {
+	d, err := p.endpoints()
+	if err != nil {
+		return "", "", err
+	}
+	vals := make([]string, 3)
+	for i := range vals {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", "", err
+		}
+		vals[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	state, nonce, verifier := vals[0], vals[1], vals[2]
+	challenge := sha256.Sum256([]byte(verifier))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", "openid profile email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), strings.Join(vals, "."), nil
+}
+
+/*
+Exchange finishes the login. It checks the state returned by the provider against the state
+cookie, swaps the code for tokens and validates the ID token. The account is built from the claims
+of the ID token.
+*/
+func (p *OIDCProvider) Exchange(cookie, state, code string) (*Account, error) {
+	vals := strings.Split(cookie, ".")
+	if len(vals) != 3 || state == "" || vals[0] != state {
+		return nil, errOIDCState
+	}
+	nonce, verifier := vals[1], vals[2]
+
+	d, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("oidc token endpoint returned %v", res.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+
+	claims, err := p.verify(tokens.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return p.account(claims)
+}
+
+/*
+verify checks the signature, issuer, audience, expiry and nonce of the ID token and returns its
+claims.
+*/
+func (p *OIDCProvider) verify(raw, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errOIDCToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errOIDCToken
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) != nil {
+			return nil, errOIDCToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errOIDCToken
+		}
+	default:
+		return nil, errOIDCToken
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, errOIDCToken
+	}
+	if !claimContains(claims["aud"], p.ClientID) {
+		return nil, errOIDCToken
+	}
+	if exp, _ := claims["exp"].(float64); time.Unix(int64(exp), 0).Before(time.Now()) {
+		return nil, errOIDCToken
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errOIDCToken
+	}
+	return claims, nil
+}
+
+/*
+account maps the claims of a verified ID token to an account, giving the highest role of the
+groups the user is in.
+*/
+func (p *OIDCProvider) account(claims map[string]interface{}) (*Account, error) {
+	username, _ := claims[p.UsernameClaim].(string)
+	if validateUsername(username) != nil {
+		return nil, errOIDCToken
+	}
+
+	var role Role
+	switch {
+	case p.AdminGroup != "" && claimContains(claims[p.GroupsClaim], p.AdminGroup):
+		role = RoleAdmin
+	case p.ResearcherGroup != "" && claimContains(claims[p.GroupsClaim], p.ResearcherGroup):
+		role = RoleResearcher
+	default:
+		return nil, errOIDCNoRole
+	}
+	return &Account{Username: username, Role: role}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errOIDCToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errOIDCToken
+	}
+	return nil
+}
+
+/*
+claimContains reports if a claim that is either a string or a list of strings contains value.
+*/
+func claimContains(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+getOIDCLogin sends the user to the OIDC provider to sign in.
+*/
+func getOIDCLogin(c *gin.Context) {
+	authURL, state, err := oidcProvider.AuthCodeURL()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   httpsAddr != "",
+	})
+	c.Redirect(303, authURL)
+}
+
+/*
+getOIDCCallback handles the user returning from the OIDC provider and logs them in with the same
+AuthToken cookie as the login form.
+*/
+func getOIDCCallback(c *gin.Context) {
+	cookie, err := c.Request.Cookie(oidcStateCookie)
+	if err != nil {
+		c.Redirect(303, "/login?oidc=failed")
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{Name: oidcStateCookie, Path: "/login/oidc", MaxAge: -1})
+
+	q := c.Request.URL.Query()
+	if q.Get("error") != "" {
+		c.Redirect(303, "/login?oidc=failed")
+		return
+	}
+	acct, err := oidcProvider.Exchange(cookie.Value, q.Get("state"), q.Get("code"))
+	if err == errOIDCNoRole {
+		audit(c, auditLoginFailed, "", "", "oidc: "+err.Error())
+		c.Redirect(303, "/login?oidc=denied")
+		return
+	} else if err != nil {
+		c.Error(err)
+		audit(c, auditLoginFailed, "", "", "oidc: "+err.Error())
+		c.Redirect(303, "/login?oidc=failed")
+		return
+	}
+
+	token, err := createSession(acct)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	audit(c, auditLogin, acct.Username, token.ID, "oidc")
+	setAuthCookie(c, token)
+	c.Redirect(303, "/")
+}
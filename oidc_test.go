@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+mockOIDCProvider is an OpenID Connect provider serving discovery, the signing keys and a token
+endpoint that checks the PKCE verifier against the challenge of the code before returning idToken.
+*/
+type mockOIDCProvider struct {
+	*httptest.Server
+	rsaKey     *rsa.PrivateKey
+	ecKey      *ecdsa.PrivateKey
+	challenges map[string]string
+	idToken    string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDCProvider{rsaKey: rsaKey, ecKey: ecKey, challenges: make(map[string]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string][]oidcJWK{"keys": {
+			{Kty: "RSA", Kid: "rsa", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X.FillBytes(make([]byte, 32))),
+				Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		challenge, ok := m.challenges[r.PostFormValue("code")]
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, 400)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.idToken})
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+/*
+provider returns an OIDCProvider of the mock that gives lab-admins the admin role and lab the
+researcher role.
+*/
+func (m *mockOIDCProvider) provider() *OIDCProvider {
+	p := NewOIDCProvider(m.URL, "activebrain", "https://activebrain.test/login/oidc/callback")
+	p.Client = m.Client()
+	p.AdminGroup = "lab-admins"
+	p.ResearcherGroup = "lab"
+	return p
+}
+
+/*
+sign returns a JWT of the claims signed with the key of the mock named by kid, with alg in its
+header.
+*/
+func (m *mockOIDCProvider) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	if kid == "ec" {
+		r, s, err := ecdsa.Sign(rand.Reader, m.ecKey, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, m.rsaKey, crypto.SHA256, hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+//claims returns valid claims of an ID token of the mock for the nonce.
+func (m *mockOIDCProvider) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                m.URL,
+		"aud":                "activebrain",
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"nonce":              nonce,
+		"preferred_username": "carol",
+		"groups":             []string{"lab"},
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	defer m.Close()
+	p := m.provider()
+
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		change func(map[string]interface{})
+		err    error
+	}{
+		{"rsa", "RS256", "rsa", nil, nil},
+		{"ec", "ES256", "ec", nil, nil},
+		{"audience list", "RS256", "rsa", func(c map[string]interface{}) { c["aud"] = []string{"other", "activebrain"} }, nil},
+		{"rsa key with ec alg", "ES256", "rsa", nil, errOIDCToken},
+		{"ec key with rsa alg", "RS256", "ec", nil, errOIDCToken},
+		{"none alg", "none", "rsa", nil, errOIDCToken},
+		{"unknown key", "RS256", "other", nil, errOIDCKey},
+		{"issuer", "RS256", "rsa", func(c map[string]interface{}) { c["iss"] = "https://evil.test" }, errOIDCToken},
+		{"audience", "RS256", "rsa", func(c map[string]interface{}) { c["aud"] = "other" }, errOIDCToken},
+		{"expired", "RS256", "rsa", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, errOIDCToken},
+		{"no expiry", "RS256", "rsa", func(c map[string]interface{}) { delete(c, "exp") }, errOIDCToken},
+		{"nonce", "RS256", "rsa", func(c map[string]interface{}) { c["nonce"] = "replayed" }, errOIDCToken},
+	}
+	for _, test := range tests {
+		claims := m.claims("n0nce")
+		if test.change != nil {
+			test.change(claims)
+		}
+		_, err := p.verify(m.sign(t, test.alg, test.kid, claims), "n0nce")
+		if err != test.err {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	//A token whose claims were changed after it was signed
+	parts := strings.Split(m.sign(t, "RS256", "rsa", m.claims("n0nce")), ".")
+	claims := m.claims("n0nce")
+	claims["groups"] = []string{"lab-admins"}
+	payload, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	if _, err := p.verify(strings.Join(parts, "."), "n0nce"); err != errOIDCToken {
+		t.Errorf("changed claims: got %v, want %v", err, errOIDCToken)
+	}
+}
+
+/*
+authorize starts a login with the provider and returns the state cookie and the state the
+provider sends back, recording the PKCE challenge of the code and the ID token it is exchanged for.
+*/
+func (m *mockOIDCProvider) authorize(t *testing.T, p *OIDCProvider, code string) (string, string) {
+	authURL, cookie, err := p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "activebrain" {
+		t.Fatalf("unexpected authorization url %v", authURL)
+	}
+	m.challenges[code] = q.Get("code_challenge")
+	m.idToken = m.sign(t, "RS256", "rsa", m.claims(q.Get("nonce")))
+	return cookie, q.Get("state")
+}
+
+func TestOIDCExchange(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	defer m.Close()
+	p := m.provider()
+
+	cookie, state := m.authorize(t, p, "c0de")
+	acct, err := p.Exchange(cookie, state, "c0de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct.Username != "carol" || acct.Role != RoleResearcher {
+		t.Errorf("got %v %v, want carol %v", acct.Username, acct.Role, RoleResearcher)
+	}
+}
+
+func TestOIDCExchangeState(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	defer m.Close()
+	p := m.provider()
+
+	cookie, state := m.authorize(t, p, "c0de")
+	for _, s := range []string{"", "other", cookie} {
+		if _, err := p.Exchange(cookie, s, "c0de"); err != errOIDCState {
+			t.Errorf("state %q: got %v, want %v", s, err, errOIDCState)
+		}
+	}
+	if _, err := p.Exchange("", state, "c0de"); err != errOIDCState {
+		t.Errorf("no cookie: got %v, want %v", err, errOIDCState)
+	}
+}
+
+func TestOIDCExchangeVerifier(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	defer m.Close()
+	p := m.provider()
+
+	cookie, state := m.authorize(t, p, "c0de")
+	parts := strings.Split(cookie, ".")
+	parts[2] = "stolen"
+	if _, err := p.Exchange(strings.Join(parts, "."), state, "c0de"); err == nil {
+		t.Error("exchanged the code with the wrong PKCE verifier")
+	}
+
+	//The nonce of the cookie must match the ID token
+	cookie, state = m.authorize(t, p, "c0de")
+	parts = strings.Split(cookie, ".")
+	parts[1] = "other"
+	if _, err := p.Exchange(strings.Join(parts, "."), state, "c0de"); err != errOIDCToken {
+		t.Errorf("wrong nonce: got %v, want %v", err, errOIDCToken)
+	}
+}
+
+func TestOIDCAccount(t *testing.T) {
+	p := NewOIDCProvider("https://idp.test", "activebrain", "")
+	p.AdminGroup = "lab-admins"
+	p.ResearcherGroup = "lab"
+
+	tests := []struct {
+		username string
+		groups   interface{}
+		role     Role
+		err      error
+	}{
+		{"carol", []interface{}{"lab", "lab-admins"}, RoleAdmin, nil},
+		{"carol", []interface{}{"lab-admins", "lab"}, RoleAdmin, nil},
+		{"carol", []interface{}{"students", "lab"}, RoleResearcher, nil},
+		{"carol", "lab", RoleResearcher, nil},
+		{"carol", []interface{}{"students"}, "", errOIDCNoRole},
+		{"carol", nil, "", errOIDCNoRole},
+		{"", []interface{}{"lab"}, "", errOIDCToken},
+		{"ca:rol", []interface{}{"lab"}, "", errOIDCToken},
+	}
+	for _, test := range tests {
+		claims := map[string]interface{}{"preferred_username": test.username, "groups": test.groups}
+		acct, err := p.account(claims)
+		if err != test.err {
+			t.Errorf("%q %v: got %v, want %v", test.username, test.groups, err, test.err)
+			continue
+		}
+		if err == nil && acct.Role != test.role {
+			t.Errorf("%q %v: got role %v, want %v", test.username, test.groups, acct.Role, test.role)
+		}
+	}
+
+	//Without a researcher group only admins can sign in
+	p.ResearcherGroup = ""
+	if _, err := p.account(map[string]interface{}{"preferred_username": "dave", "groups": "lab"}); err != errOIDCNoRole {
+		t.Errorf("no researcher group: got %v, want %v", err, errOIDCNoRole)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	bcryptPrefix   = "$2"
+	argon2idPrefix = "$argon2id$"
+
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var (
+	errUnknownAlgorithm = errors.New("unknown password hashing algorithm")
+	errInvalidHash      = errors.New("invalid password hash")
+
+	//dummyHash is compared against when the username is unknown so a failed lookup takes
+	//roughly as long as a failed password.
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("activebrain"), bcrypt.DefaultCost)
+)
+
+/*
+isHashedPassword reports if the stored password is a supported hash rather than plain text.
+*/
+func isHashedPassword(stored string) bool {
+	return strings.HasPrefix(stored, bcryptPrefix) || strings.HasPrefix(stored, argon2idPrefix)
+}
+
+/*
+checkPassword compares a password attempt against the stored password. The stored password may
+be a bcrypt hash, an argon2id hash or plain text. All comparisons are constant time.
+*/
+func checkPassword(stored, attempt string) bool {
+	switch {
+	case strings.HasPrefix(stored, bcryptPrefix):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(attempt)) == nil
+	case strings.HasPrefix(stored, argon2idPrefix):
+		ok, err := compareArgon2id(stored, attempt)
+		return err == nil && ok
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(attempt)) == 1
+	}
+}
+
+/*
+rejectPassword burns the same time as a bcrypt comparison and always fails. It is used when the
+username does not exist.
+*/
+func rejectPassword(attempt string) bool {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(attempt))
+	return false
+}
+
+/*
+hashPassword hashes the password with the requested algorithm, either bcrypt or argon2id.
+*/
+func hashPassword(algo, password string) (string, error) {
+	switch algo {
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case "argon2id":
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("%vv=%d$m=%d,t=%d,p=%d$%v$%v", argon2idPrefix, argon2.Version,
+			argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", errUnknownAlgorithm
+}
+
+/*
+compareArgon2id decodes a hash in the form
+
+	$argon2id$v=19$m=65536,t=1,p=4$salt$key
+
+and compares it against the attempt.
+*/
+func compareArgon2id(stored, attempt string) (bool, error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false, errInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, errInvalidHash
+	}
+	if version != argon2.Version {
+		return false, errInvalidHash
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errInvalidHash
+	}
+	//argon2 panics on parameters out of its range, a bad line in the accounts file must not
+	if threads < 1 || time < 1 || memory < 8*uint32(threads) {
+		return false, errInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, errInvalidHash
+	}
+	other := argon2.IDKey([]byte(attempt), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+/*
+hashPasswordCommand implements the hash-password command. It reads the password from stdin and
+prints a line that can be pasted into the accounts file.
+
+	activebrain hash-password [-algo bcrypt|argon2id] username
+*/
+func hashPasswordCommand(args []string) error {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	algo := fs.String("algo", "bcrypt", "hashing algorithm to use, bcrypt or argon2id")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: activebrain hash-password [-algo bcrypt|argon2id] username")
+	}
+	username := fs.Arg(0)
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("no password provided")
+	}
+
+	hash, err := hashPassword(*algo, scanner.Text())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v:%v\n", username, hash)
+	return nil
+}
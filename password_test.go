@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	for _, algo := range []string{"bcrypt", "argon2id"} {
+		hash, err := hashPassword(algo, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isHashedPassword(hash) {
+			t.Errorf("%v: %q is not recognised as a hash", algo, hash)
+		}
+		if !checkPassword(hash, "secret") {
+			t.Errorf("%v: the password was rejected", algo)
+		}
+		if checkPassword(hash, "wrong") {
+			t.Errorf("%v: a wrong password was accepted", algo)
+		}
+	}
+
+	if !checkPassword("secret", "secret") || checkPassword("secret", "wrong") {
+		t.Error("plain text passwords are not compared")
+	}
+}
+
+func TestCompareArgon2idInvalid(t *testing.T) {
+	hash, err := hashPassword("argon2id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+
+	tests := []struct {
+		name  string
+		part  int
+		value string
+	}{
+		{"no threads", 3, "m=65536,t=1,p=0"},
+		{"no time", 3, "m=65536,t=0,p=4"},
+		{"too little memory", 3, "m=31,t=1,p=4"},
+		{"no memory", 3, "m=0,t=1,p=1"},
+		{"parameters", 3, "m=65536"},
+		{"version", 2, "v=16"},
+		{"salt", 4, "!"},
+		{"key", 5, "!"},
+		{"empty key", 5, ""},
+	}
+	for _, test := range tests {
+		changed := append([]string(nil), parts...)
+		changed[test.part] = test.value
+		stored := strings.Join(changed, "$")
+		if _, err := compareArgon2id(stored, "secret"); err != errInvalidHash {
+			t.Errorf("%v: got %v, want %v", test.name, err, errInvalidHash)
+		}
+		if checkPassword(stored, "secret") {
+			t.Errorf("%v: the password was accepted", test.name)
+		}
+	}
+
+	if _, err := compareArgon2id(hash+"$extra", "secret"); err != errInvalidHash {
+		t.Errorf("extra field: got %v, want %v", err, errInvalidHash)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 )
 
 //Results the expected data format from the client
@@ -17,6 +18,14 @@ type StoredResults struct {
 	Task    string
 	Columns map[string]struct{}
 	Results Results
+	//Duplicate numbers the results of a task that was submitted again in the same session
+	Duplicate int
+	//OrderGroup and OrderPosition are the group of the task order of the session, counting from 1,
+	//and the position of the task in it, 0 if it is not in it. OutOfOrder marks results that came
+	//before those of a task earlier in the order.
+	OrderGroup    int
+	OrderPosition int
+	OutOfOrder    bool
 }
 
 //NewStoredResults creates a new StoredResult from a Results object
@@ -39,7 +48,7 @@ func NewStoredResults(res Results) StoredResults {
 	return r
 }
 
-func (r *StoredResults) writeToDisk(token *AuthToken) error {
+func (r *StoredResults) writeToDisk(dir string, token *AuthToken) error {
 	var fileName string
 	columns := make([]string, 0, len(r.Columns))
 
@@ -48,10 +57,21 @@ func (r *StoredResults) writeToDisk(token *AuthToken) error {
 	}
 
 	sort.Strings(columns)
+	//The task order is recorded with every row, unless the frontend already sent the columns
+	order := []string{"OrderGroup", "OrderPosition", "OutOfOrder"}
+	for _, col := range order {
+		if _, exists := r.Columns[col]; !exists {
+			columns = append(columns, col)
+		}
+	}
 
-	fileName = fmt.Sprintf("%v-%v-%02d-%v.csv", token.Expiration.Format("20060102T150405"), token.User, token.Num, r.Task)
+	stamp := token.SessionTime.Format("20060102T150405")
+	fileName = fmt.Sprintf("%v-%v-%02d-%v.csv", stamp, token.User, token.Num, r.Task)
+	if r.Duplicate > 0 {
+		fileName = fmt.Sprintf("%v-%v-%02d-%v-dup%d.csv", stamp, token.User, token.Num, r.Task, r.Duplicate)
+	}
 
-	f, err := os.OpenFile(filepath.Join(outputPath, fileName), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.ModePerm)
+	f, err := os.OpenFile(filepath.Join(dir, fileName), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.ModePerm)
 	if err != nil {
 		return err
 	}
@@ -72,6 +92,16 @@ func (r *StoredResults) writeToDisk(token *AuthToken) error {
 				values[i] = ""
 			}
 		}
+		for i := len(r.Columns); i < len(columns); i++ {
+			switch columns[i] {
+			case "OrderGroup":
+				values[i] = strconv.Itoa(r.OrderGroup)
+			case "OrderPosition":
+				values[i] = strconv.Itoa(r.OrderPosition)
+			case "OutOfOrder":
+				values[i] = strconv.FormatBool(r.OutOfOrder)
+			}
+		}
 		if err := writer.Write(values); err != nil {
 			return err
 		}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//readResultsFile returns the rows of the only results file written to dir.
+func readResultsFile(t *testing.T, dir string) [][]string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("wrote %v results files, want 1", len(files))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestWriteToDiskTaskOrder(t *testing.T) {
+	token := &AuthToken{User: "alice", Num: 3, SessionTime: time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)}
+	for _, test := range []struct {
+		name    string
+		results Results
+		want    [][]string
+	}{
+		{"order columns", Results{
+			{"Task": "Flanker", "Trial": 1, "RT": 512},
+			{"Task": "Flanker", "Trial": 2, "RT": 430},
+		}, [][]string{
+			{"RT", "Trial", "OrderGroup", "OrderPosition", "OutOfOrder"},
+			{"512", "1", "2", "3", "true"},
+			{"430", "2", "2", "3", "true"},
+		}},
+		//Columns the frontend already sent are kept rather than repeated
+		{"frontend columns", Results{
+			{"Task": "Flanker", "Trial": 1, "OrderPosition": 1},
+		}, [][]string{
+			{"OrderPosition", "Trial", "OrderGroup", "OutOfOrder"},
+			{"1", "1", "2", "true"},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sr := NewStoredResults(test.results)
+			sr.OrderGroup = 2
+			sr.OrderPosition = 3
+			sr.OutOfOrder = true
+			if err := sr.writeToDisk(dir, token); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "20240501T093000-alice-03-Flanker.csv")); err != nil {
+				t.Error(err)
+			}
+			if rows := readResultsFile(t, dir); !reflect.DeepEqual(rows, test.want) {
+				t.Errorf("wrote %v, want %v", rows, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+resumeKey is the key the unfinished session of a user is kept under so it can be resumed after the
+token has gone, e.g. when the browser crashed part way through the tasks.
+*/
+func resumeKey(username string) string {
+	return "session:resume:" + username
+}
+
+/*
+saveResumable keeps the state of the session after a task so it can be resumed for resumeWindow.
+*/
+func saveResumable(token *AuthToken) error {
+	if resumeWindow <= 0 {
+		return nil
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return sessions.SetValue(resumeKey(token.User), string(b), resumeWindow)
+}
+
+/*
+clearResumable forgets the unfinished session of the user once it has been finished.
+*/
+func clearResumable(username string) error {
+	return sessions.DeleteValues(resumeKey(username))
+}
+
+/*
+getResumable returns the unfinished session the token could resume, or nil if there is none. Only
+tokens that have not completed a task of their own can resume a session.
+*/
+func getResumable(token *AuthToken) (*AuthToken, error) {
+	if resumeWindow <= 0 || token.Demo || token.Tasks > 0 {
+		return nil, nil
+	}
+	val, ok, err := sessions.GetValue(resumeKey(token.User))
+	if err != nil || !ok {
+		return nil, err
+	}
+	var session AuthToken
+	if err := json.Unmarshal([]byte(val), &session); err != nil {
+		return nil, err
+	}
+	//The token is already in that session
+	if session.ID == token.ID {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+/*
+resumableProps describes the unfinished session for the participant to decide whether to resume it.
+*/
+func resumableProps(session *AuthToken) gin.H {
+	return gin.H{
+		"ID":             session.Num,
+		"Tasks":          session.Tasks,
+		"CompletedTasks": session.CompletedTasks(),
+		"PendingTasks":   session.PendingTasks(),
+	}
+}
+
+/*
+postSessionResume continues the unfinished session of the participant with the current token. The
+token takes over the session number, the time the results files are named after and the completed
+tasks, and the token of the unfinished session is expired in case it is still open somewhere.
+*/
+func postSessionResume(c *gin.Context) {
+	token := c.MustGet("token").(*AuthToken)
+
+	if token.Tasks > 0 {
+		c.JSON(409, gin.H{"error": errSessionStarted.Error()})
+		return
+	}
+	session, err := getResumable(token)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	} else if session == nil {
+		c.JSON(404, gin.H{"error": errNoResumable.Error()})
+		return
+	}
+
+	token.Num = session.Num
+	token.SessionTime = session.SessionTime
+	token.TaskQuota = session.TaskQuota
+	token.Tasks = session.Tasks
+	token.Completed = session.Completed
+	token.Duplicates = session.Duplicates
+	token.Resumed = session.Resumed + 1
+	if err := sessions.Resume(token); err == errNoToken {
+		unauthenticated(c)
+		return
+	} else if err == errSessionStarted {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if err := sessions.Expire(session); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if err := ledger.Record(token, false); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if err := saveResumable(token); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	audit(c, auditResumed, token.User, token.ID,
+		"session "+strconv.Itoa(token.Num)+" after "+strconv.Itoa(token.Tasks)+" tasks")
+	getSession(c)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+MemorySessionStore is a SessionStore that keeps everything in the memory of the server so it can
+run without redis on a single machine. Sessions are lost when the server restarts.
+*/
+type MemorySessionStore struct {
+	mu     sync.Mutex
+	tokens map[string]AuthToken
+	counts map[string]memorySessionCount
+	values map[string]memoryValue
+}
+
+//memorySessionCount is the number of sessions of a user until Expiration.
+type memorySessionCount struct {
+	Count      int
+	Expiration time.Time
+}
+
+//memoryValue is a short lived value that is removed once Expiration passes.
+type memoryValue struct {
+	Value      string
+	Expiration time.Time
+}
+
+/*
+NewMemorySessionStore creates a MemorySessionStore and starts removing expired entries in the
+background.
+*/
+func NewMemorySessionStore() *MemorySessionStore {
+	s := &MemorySessionStore{
+		tokens: make(map[string]AuthToken),
+		counts: make(map[string]memorySessionCount),
+		values: make(map[string]memoryValue),
+	}
+	go s.expireService(time.Minute)
+	return s
+}
+
+/*
+expireService removes the expired tokens, counts and values every interval so they do not use up
+memory. Lookups check the expiration themselves so nothing is used after it expires.
+*/
+func (s *MemorySessionStore) expireService(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.mu.Lock()
+		for id, token := range s.tokens {
+			if !token.Expiration.After(now) {
+				delete(s.tokens, id)
+			}
+		}
+		for user, count := range s.counts {
+			if !count.Expiration.After(now) {
+				delete(s.counts, user)
+			}
+		}
+		for key, value := range s.values {
+			if !value.Expiration.After(now) {
+				delete(s.values, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+/*
+Get returns a copy of the token so callers cannot change the stored token.
+*/
+func (s *MemorySessionStore) Get(id string) (*AuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok || !token.Expiration.After(time.Now()) {
+		return nil, errNoToken
+	}
+	clone := cloneToken(&token)
+	return &clone, nil
+}
+
+/*
+cloneToken copies the token along with its maps so the copy can be changed without holding mu.
+*/
+func cloneToken(token *AuthToken) AuthToken {
+	clone := *token
+	clone.Completed = make(map[string]time.Time, len(token.Completed))
+	for task, at := range token.Completed {
+		clone.Completed[task] = at
+	}
+	clone.Duplicates = make(map[string]int, len(token.Duplicates))
+	for task, n := range token.Duplicates {
+		clone.Duplicates[task] = n
+	}
+	return clone
+}
+
+/*
+Create creates a new AuthToken for the account triggering a new session
+*/
+func (s *MemorySessionStore) Create(acct *Account, num int) (*AuthToken, error) {
+	token, err := newAuthToken(acct, num)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.tokens[token.ID] = cloneToken(token)
+	s.mu.Unlock()
+	return token, nil
+}
+
+/*
+SessionCount returns the number of sessions of the user within sessCountMonths.
+*/
+func (s *MemorySessionStore) SessionCount(username string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if count, ok := s.counts[username]; ok && count.Expiration.After(time.Now()) {
+		return count.Count, nil
+	}
+	return 0, nil
+}
+
+/*
+CompleteTask records that the task was completed and counts it against the token. The first task of
+a session also counts the session against the user and the task that completes the quota expires the
+token. The counts are taken from the stored token while holding mu.
+*/
+func (s *MemorySessionStore) CompleteTask(token *AuthToken, task string) (TaskResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	stored, ok := s.tokens[token.ID]
+	if !ok || !stored.Expiration.After(now) {
+		return TaskResult{}, errNoToken
+	}
+	if _, done := stored.Completed[task]; done {
+		stored.Duplicates[task]++
+		token.Duplicates[task] = stored.Duplicates[task]
+		return TaskResult{Tasks: stored.Tasks}, nil
+	}
+
+	if stored.Tasks == 0 {
+		count, ok := s.counts[token.User]
+		if ok && count.Expiration.After(now) {
+			count.Count++
+		} else {
+			count = memorySessionCount{Count: 1, Expiration: nextSessionCountReset(now)}
+		}
+		s.counts[token.User] = count
+	}
+	at := now.Truncate(time.Second)
+	stored.Completed[task] = at
+	stored.Tasks++
+	stored.LastActivity = at
+	res := TaskResult{Completed: true, Tasks: stored.Tasks, Expired: stored.QuotaReached()}
+	if res.Expired {
+		delete(s.tokens, token.ID)
+	} else {
+		s.tokens[token.ID] = stored
+	}
+
+	token.Tasks = stored.Tasks
+	token.TaskQuota = stored.TaskQuota
+	token.Completed[task] = at
+	token.LastActivity = at
+	return res, nil
+}
+
+/*
+Expire ends the session by deleting the token.
+*/
+func (s *MemorySessionStore) Expire(token *AuthToken) error {
+	s.mu.Lock()
+	delete(s.tokens, token.ID)
+	s.mu.Unlock()
+	return nil
+}
+
+/*
+Extend moves the expiration of the token.
+*/
+func (s *MemorySessionStore) Extend(token *AuthToken, expiration time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.tokens[token.ID]
+	if !ok || !stored.Expiration.After(time.Now()) {
+		return errNoToken
+	}
+	stored.Expiration = expiration
+	s.tokens[token.ID] = stored
+	token.Expiration = expiration
+	return nil
+}
+
+/*
+Resume saves the session state copied into the token.
+*/
+func (s *MemorySessionStore) Resume(token *AuthToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.tokens[token.ID]
+	now := time.Now()
+	if !ok || !stored.Expiration.After(now) {
+		return errNoToken
+	} else if stored.Tasks != 0 {
+		return errSessionStarted
+	}
+	token.LastActivity = now.Truncate(time.Second)
+	s.tokens[token.ID] = cloneToken(token)
+	return nil
+}
+
+/*
+List returns copies of the tokens that have not expired.
+*/
+func (s *MemorySessionStore) List() ([]*AuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	list := []*AuthToken{}
+	for _, token := range s.tokens {
+		if token.Expiration.After(now) {
+			clone := cloneToken(&token)
+			list = append(list, &clone)
+		}
+	}
+	return list, nil
+}
+
+/*
+value returns the value of the key if it has not expired. It must be called with mu held.
+*/
+func (s *MemorySessionStore) value(key string, now time.Time) (memoryValue, bool) {
+	v, ok := s.values[key]
+	if !ok || !v.Expiration.After(now) {
+		return memoryValue{}, false
+	}
+	return v, true
+}
+
+/*
+SetValue sets the key to value until ttl passes.
+*/
+func (s *MemorySessionStore) SetValue(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	s.values[key] = memoryValue{Value: value, Expiration: time.Now().Add(ttl)}
+	s.mu.Unlock()
+	return nil
+}
+
+/*
+SetValueNX sets the key to value until ttl passes if the key does not exist.
+*/
+func (s *MemorySessionStore) SetValueNX(key, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := s.value(key, now); ok {
+		return false, nil
+	}
+	s.values[key] = memoryValue{Value: value, Expiration: now.Add(ttl)}
+	return true, nil
+}
+
+/*
+GetValue returns the value of the key.
+*/
+func (s *MemorySessionStore) GetValue(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.value(key, time.Now())
+	return v.Value, ok, nil
+}
+
+/*
+TTL returns the time left before the key expires.
+*/
+func (s *MemorySessionStore) TTL(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	v, ok := s.value(key, now)
+	if !ok {
+		return 0, nil
+	}
+	return v.Expiration.Sub(now), nil
+}
+
+/*
+Incr increments the counter at key and sets it to expire after ttl.
+*/
+func (s *MemorySessionStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var n int64
+	if v, ok := s.value(key, now); ok {
+		var err error
+		if n, err = strconv.ParseInt(v.Value, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	n++
+	s.values[key] = memoryValue{Value: strconv.FormatInt(n, 10), Expiration: now.Add(ttl)}
+	return n, nil
+}
+
+/*
+DeleteValues removes the keys.
+*/
+func (s *MemorySessionStore) DeleteValues(keys ...string) error {
+	s.mu.Lock()
+	for _, key := range keys {
+		delete(s.values, key)
+	}
+	s.mu.Unlock()
+	return nil
+}
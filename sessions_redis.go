@@ -0,0 +1,627 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fzzy/radix/redis"
+)
+
+/*
+RedisSessionStore is a SessionStore that keeps each AuthToken as a hash in redis under its id using
+rpool, expiring with the token. The completed tasks are kept in the same hash as Task:<name> fields
+holding when they were completed and their duplicates as Duplicate:<name> counts. The number of
+sessions of each user is kept in a hash under sessionCountKey and the ids of the tokens that have
+not expired in the sorted set redisActiveTokens, scored by when they expire.
+*/
+type RedisSessionStore struct{}
+
+//redisActiveTokens is the sorted set of the ids of the tokens that have not expired.
+const redisActiveTokens = "sessions:active"
+
+//redisTaskRetries is the number of times CompleteTask is tried when the count of sessions of the
+//user is reset by another session at the same time.
+const redisTaskRetries = 5
+
+/*
+redisCompleteTaskScript records the task ARGV[1] completed at ARGV[2] in the token KEYS[1]. It
+returns {-1} if the token does not exist, {0, tasks, duplicates} for a task that was already
+completed and {1, tasks, expired} otherwise. The token is deleted, along with its id in KEYS[3],
+once the tasks reach its quota, ARGV[3] for tokens without one, unless it is unlimitedTasks (-1).
+The first task counts the session in the hash of the user KEYS[2], whose Expiration must still be
+ARGV[4] or {-2} is returned to try again. The count is incremented if ARGV[5] is true and
+otherwise started over until ARGV[6], expiring after ARGV[7] seconds.
+*/
+const redisCompleteTaskScript = `
+local tasks = redis.call("HGET", KEYS[1], "Tasks")
+if not tasks then
+	return {-1}
+end
+tasks = tonumber(tasks)
+if redis.call("HEXISTS", KEYS[1], "Task:" .. ARGV[1]) == 1 then
+	return {0, tasks, redis.call("HINCRBY", KEYS[1], "Duplicate:" .. ARGV[1], 1)}
+end
+if tasks == 0 then
+	if (redis.call("HGET", KEYS[2], "Expiration") or "") ~= ARGV[4] then
+		return {-2}
+	end
+	if ARGV[5] == "true" then
+		redis.call("HINCRBY", KEYS[2], "Count", 1)
+	else
+		redis.call("HMSET", KEYS[2], "Count", 1, "Expiration", ARGV[6])
+	end
+	redis.call("EXPIRE", KEYS[2], ARGV[7])
+end
+redis.call("HMSET", KEYS[1], "Task:" .. ARGV[1], ARGV[2], "LastActivity", ARGV[2])
+tasks = redis.call("HINCRBY", KEYS[1], "Tasks", 1)
+local quota = tonumber(redis.call("HGET", KEYS[1], "TaskQuota") or ARGV[3])
+if quota ~= -1 and tasks >= quota then
+	redis.call("DEL", KEYS[1])
+	redis.call("ZREM", KEYS[3], KEYS[1])
+	return {1, tasks, 1}
+end
+return {1, tasks, 0}
+`
+
+//redisExtendScript only changes the expiration of a token that still exists so an expired token
+//is not brought back as a hash without the rest of its fields.
+const redisExtendScript = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "Expiration", ARGV[1])
+redis.call("EXPIREAT", KEYS[1], ARGV[2])
+redis.call("ZADD", KEYS[2], ARGV[2], KEYS[1])
+return 1
+`
+
+//redisResumeScript sets the fields of a token that still exists and has not completed a task. It
+//returns 0 if the token does not exist and -1 if it has completed a task.
+const redisResumeScript = `
+local tasks = redis.call("HGET", KEYS[1], "Tasks")
+if not tasks then
+	return 0
+end
+if tonumber(tasks) ~= 0 then
+	return -1
+end
+redis.call("HMSET", KEYS[1], unpack(ARGV))
+return 1
+`
+
+//redisMigrateCountScript moves the count of sessions of a user from the hash under the bare
+//username KEYS[1] to KEYS[2], unless KEYS[1] is not such a hash or KEYS[2] exists.
+const redisMigrateCountScript = `
+if redis.call("TYPE", KEYS[1]).ok ~= "hash" or redis.call("HEXISTS", KEYS[1], "Count") == 0 then
+	return 0
+end
+return redis.call("RENAMENX", KEYS[1], KEYS[2])
+`
+
+//sessionCountKey is the key of the hash counting the sessions of the user.
+func sessionCountKey(username string) string {
+	return "count:" + username
+}
+
+/*
+NewRedisSessionStore creates a new RedisSessionStore, moving the counts of sessions kept under the
+bare usernames by earlier versions to sessionCountKey.
+*/
+func NewRedisSessionStore() (*RedisSessionStore, error) {
+	if err := migrateRedisSessionCounts(); err != nil {
+		return nil, err
+	}
+	return &RedisSessionStore{}, nil
+}
+
+/*
+migrateRedisSessionCounts scans the keys without a prefix, which are the ids of tokens and the
+counts of sessions of earlier versions, and moves the counts to sessionCountKey.
+*/
+func migrateRedisSessionCounts() (err error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	cursor := "0"
+	for {
+		rep := c.Cmd("SCAN", cursor, "COUNT", 1000)
+		if err = rep.Err; err != nil {
+			return err
+		}
+		if len(rep.Elems) != 2 {
+			return errUnexpectedReply
+		}
+		if cursor, err = rep.Elems[0].Str(); err != nil {
+			return err
+		}
+		var keys []string
+		if keys, err = rep.Elems[1].List(); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if strings.Contains(key, ":") {
+				continue
+			}
+			if err = c.Cmd("EVAL", redisMigrateCountScript, 2, key, sessionCountKey(key)).Err; err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+/*
+Get fetchs a token from the database using the provided id
+*/
+func (s *RedisSessionStore) Get(token string) (*AuthToken, error) {
+	var auth AuthToken
+	c, err := rpool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	rep := c.Cmd("HGETALL", token)
+	if rep.Err != nil {
+		return nil, rep.Err
+	} else if rep.Type == redis.NilReply {
+		return nil, errNoToken
+	}
+	var vals map[string]string
+	vals, err = rep.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return nil, errNoToken
+	}
+	auth.User = vals["User"]
+	auth.Demo = vals["Demo"] == "true"
+	//Tokens created before roles existed have no role and belong to participants.
+	auth.Role, err = ParseRole(vals["Role"])
+	if err != nil {
+		return nil, err
+	}
+	auth.Expiration, err = time.Parse(time.RFC3339, vals["Expiration"])
+	if err != nil {
+		return nil, err
+	}
+	//Tokens created before they could be extended were created tokenExpiration before they expire.
+	if vals["Created"] == "" {
+		auth.Created = auth.Expiration.Add(-tokenExpiration)
+	} else if auth.Created, err = time.Parse(time.RFC3339, vals["Created"]); err != nil {
+		return nil, err
+	}
+	//Tokens created before sessions could be resumed are named after their first expiration.
+	if vals["SessionTime"] == "" {
+		auth.SessionTime = auth.Created.Add(tokenExpiration)
+	} else if auth.SessionTime, err = time.Parse(time.RFC3339, vals["SessionTime"]); err != nil {
+		return nil, err
+	}
+	var temp int64
+	temp, err = strconv.ParseInt(vals["Tasks"], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	auth.Tasks = int(temp)
+
+	temp, err = strconv.ParseInt(vals["Num"], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	auth.Num = int(temp)
+	auth.ID = token
+
+	//Tokens created before the last activity was kept were last active when they were created.
+	auth.LastActivity = auth.Created
+	if vals["LastActivity"] != "" {
+		if auth.LastActivity, err = time.Parse(time.RFC3339, vals["LastActivity"]); err != nil {
+			return nil, err
+		}
+	}
+
+	if vals["Resumed"] != "" {
+		if auth.Resumed, err = strconv.Atoi(vals["Resumed"]); err != nil {
+			return nil, err
+		}
+	}
+
+	auth.Completed = make(map[string]time.Time)
+	auth.Duplicates = make(map[string]int)
+	for field, val := range vals {
+		if strings.HasPrefix(field, "Task:") {
+			at, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return nil, err
+			}
+			auth.Completed[field[len("Task:"):]] = at
+		} else if strings.HasPrefix(field, "Duplicate:") {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+			auth.Duplicates[field[len("Duplicate:"):]] = n
+		}
+	}
+
+	//Tokens created before quotas could be configured use the quota of the server.
+	auth.TaskQuota = taskQuota
+	if vals["TaskQuota"] != "" {
+		temp, err = strconv.ParseInt(vals["TaskQuota"], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		auth.TaskQuota = int(temp)
+	}
+
+	return &auth, nil
+}
+
+/*
+SessionCount returns the number of sessions of the user within sessCountMonths.
+*/
+func (s *RedisSessionStore) SessionCount(username string) (int, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return 0, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	res := c.Cmd("HMGET", sessionCountKey(username), "Count", "Expiration")
+	if res.Err != nil {
+		return 0, res.Err
+	} else if res.Type == redis.NilReply {
+		return 0, nil
+	}
+	vals, err := res.List()
+	if err != nil {
+		return 0, err
+	}
+	if vals[0] == "" || vals[1] == "" {
+		return 0, nil
+	}
+	exp, err := time.Parse(time.RFC3339, vals[1])
+	if err != nil {
+		return 0, err
+	}
+	if !exp.After(time.Now()) {
+		return 0, nil
+	}
+	num, err := strconv.ParseInt(vals[0], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int(num), nil
+}
+
+/*
+Create creates a new AuthToken for the account triggering a new session
+*/
+func (s *RedisSessionStore) Create(acct *Account, num int) (*AuthToken, error) {
+	token, err := newAuthToken(acct, num)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := rpool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	c.Append("HMSET", token.ID,
+		"User", token.User,
+		"Role", string(token.Role),
+		"Demo", strconv.FormatBool(token.Demo),
+		"Expiration", token.Expiration.Format(time.RFC3339),
+		"Created", token.Created.Format(time.RFC3339),
+		"SessionTime", token.SessionTime.Format(time.RFC3339),
+		"Tasks", token.Tasks,
+		"TaskQuota", token.TaskQuota,
+		"Num", token.Num,
+		"LastActivity", token.LastActivity.Format(time.RFC3339))
+	c.Append("EXPIRE", token.ID, int64(tokenExpiration.Seconds()))
+	c.Append("ZADD", redisActiveTokens, token.Expiration.Unix(), token.ID)
+
+	for i := 0; i < 3; i++ {
+		if err = c.GetReply().Err; err != nil {
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+/*
+CompleteTask records that the task was completed and counts it against the token. The first task of
+a session also counts the session against the user and the task that completes the quota expires the
+token. All of it is done by redisCompleteTaskScript so concurrent results are counted once each.
+*/
+func (s *RedisSessionStore) CompleteTask(token *AuthToken, task string) (TaskResult, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return TaskResult{}, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	for i := 0; i < redisTaskRetries; i++ {
+		//The script can not parse the expiration of the count of sessions so it is checked here
+		//and the script only counts the session if it has not changed since.
+		now := time.Now()
+		next := nextSessionCountReset(now)
+		rep := c.Cmd("HGET", sessionCountKey(token.User), "Expiration")
+		if err = rep.Err; err != nil {
+			return TaskResult{}, err
+		}
+		expiration, counting := "", false
+		if rep.Type != redis.NilReply {
+			expiration = rep.String()
+			var exp time.Time
+			if exp, err = time.Parse(time.RFC3339, expiration); err != nil {
+				return TaskResult{}, err
+			}
+			counting = exp.After(now)
+		}
+
+		at := now.Truncate(time.Second)
+		rep = c.Cmd("EVAL", redisCompleteTaskScript, 3, token.ID, sessionCountKey(token.User), redisActiveTokens,
+			task, at.Format(time.RFC3339), taskQuota, expiration, strconv.FormatBool(counting),
+			next.Format(time.RFC3339), int64(next.Sub(now).Seconds()))
+		if err = rep.Err; err != nil {
+			return TaskResult{}, err
+		}
+		var vals []int64
+		for _, e := range rep.Elems {
+			n, err := e.Int64()
+			if err != nil {
+				return TaskResult{}, err
+			}
+			vals = append(vals, n)
+		}
+
+		switch vals[0] {
+		case -1:
+			return TaskResult{}, errNoToken
+		case 0:
+			token.Duplicates[task] = int(vals[2])
+			return TaskResult{Tasks: int(vals[1])}, nil
+		case 1:
+			token.Tasks = int(vals[1])
+			token.Completed[task] = at
+			token.LastActivity = at
+			return TaskResult{Completed: true, Tasks: int(vals[1]), Expired: vals[2] == 1}, nil
+		}
+	}
+	return TaskResult{}, errSessionConflict
+}
+
+/*
+Expire ends the session by deleting the token.
+*/
+func (s *RedisSessionStore) Expire(token *AuthToken) error {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	c.Append("DEL", token.ID)
+	c.Append("ZREM", redisActiveTokens, token.ID)
+	for i := 0; i < 2; i++ {
+		if err = c.GetReply().Err; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Extend moves the expiration of the token.
+*/
+func (s *RedisSessionStore) Extend(token *AuthToken, expiration time.Time) error {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var ok int64
+	ok, err = c.Cmd("EVAL", redisExtendScript, 2, token.ID, redisActiveTokens,
+		expiration.Format(time.RFC3339), expiration.Unix()).Int64()
+	if err != nil {
+		return err
+	} else if ok == 0 {
+		return errNoToken
+	}
+	token.Expiration = expiration
+	return nil
+}
+
+/*
+Resume saves the session state copied into the token.
+*/
+func (s *RedisSessionStore) Resume(token *AuthToken) error {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	lastActivity := time.Now().Truncate(time.Second)
+	args := []interface{}{redisResumeScript, 1, token.ID,
+		"Num", token.Num,
+		"SessionTime", token.SessionTime.Format(time.RFC3339),
+		"TaskQuota", token.TaskQuota,
+		"Tasks", token.Tasks,
+		"Resumed", token.Resumed,
+		"LastActivity", lastActivity.Format(time.RFC3339)}
+	for task, at := range token.Completed {
+		args = append(args, "Task:"+task, at.Format(time.RFC3339))
+	}
+	for task, n := range token.Duplicates {
+		args = append(args, "Duplicate:"+task, n)
+	}
+	var ok int64
+	if ok, err = c.Cmd("EVAL", args...).Int64(); err != nil {
+		return err
+	} else if ok == 0 {
+		return errNoToken
+	} else if ok == -1 {
+		return errSessionStarted
+	}
+	token.LastActivity = lastActivity
+	return nil
+}
+
+/*
+List returns the tokens in redisActiveTokens, dropping the ids of the tokens that have expired.
+Tokens created before redisActiveTokens was kept are not listed.
+*/
+func (s *RedisSessionStore) List() ([]*AuthToken, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	if err = c.Cmd("ZREMRANGEBYSCORE", redisActiveTokens, "-inf", time.Now().Unix()).Err; err != nil {
+		return nil, err
+	}
+	var ids []string
+	if ids, err = c.Cmd("ZRANGE", redisActiveTokens, 0, -1).List(); err != nil {
+		return nil, err
+	}
+
+	list := []*AuthToken{}
+	for _, id := range ids {
+		token, err := s.Get(id)
+		if err == errNoToken {
+			//Deleted without removing its id, e.g. by an older version
+			if err := c.Cmd("ZREM", redisActiveTokens, id).Err; err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		list = append(list, token)
+	}
+	return list, nil
+}
+
+/*
+SetValue sets the key to value until ttl passes.
+*/
+func (s *RedisSessionStore) SetValue(key, value string, ttl time.Duration) error {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	err = c.Cmd("SET", key, value, "PX", int64(ttl/time.Millisecond)).Err
+	return err
+}
+
+/*
+SetValueNX sets the key to value until ttl passes if the key does not exist.
+*/
+func (s *RedisSessionStore) SetValueNX(key, value string, ttl time.Duration) (bool, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return false, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	rep := c.Cmd("SET", key, value, "PX", int64(ttl/time.Millisecond), "NX")
+	if err = rep.Err; err != nil {
+		return false, err
+	}
+	return rep.Type != redis.NilReply, nil
+}
+
+/*
+GetValue returns the value of the key.
+*/
+func (s *RedisSessionStore) GetValue(key string) (string, bool, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return "", false, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	rep := c.Cmd("GET", key)
+	if err = rep.Err; err != nil {
+		return "", false, err
+	} else if rep.Type == redis.NilReply {
+		return "", false, nil
+	}
+	var value string
+	value, err = rep.Str()
+	return value, err == nil, err
+}
+
+/*
+TTL returns the time left before the key expires.
+*/
+func (s *RedisSessionStore) TTL(key string) (time.Duration, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return 0, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var ms int64
+	if ms, err = c.Cmd("PTTL", key).Int64(); err != nil {
+		return 0, err
+	}
+	//PTTL is negative for keys that do not exist or never expire.
+	if ms < 0 {
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+/*
+Incr increments the counter at key and sets it to expire after ttl.
+*/
+func (s *RedisSessionStore) Incr(key string, ttl time.Duration) (int64, error) {
+	c, err := rpool.Get()
+	if err != nil {
+		return 0, err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	var n int64
+	if n, err = c.Cmd("INCR", key).Int64(); err != nil {
+		return 0, err
+	}
+	if err = c.Cmd("PEXPIRE", key, int64(ttl/time.Millisecond)).Err; err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+/*
+DeleteValues removes the keys.
+*/
+func (s *RedisSessionStore) DeleteValues(keys ...string) error {
+	c, err := rpool.Get()
+	if err != nil {
+		return err
+	}
+	defer rpool.CarefullyPut(c, &err)
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	err = c.Cmd("DEL", args...).Err
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fzzy/radix/extra/pool"
+	"github.com/fzzy/radix/redis"
+	"github.com/nu7hatch/gouuid"
+)
+
+/*
+redisTestPool connects rpool to the redis at REDIS_PORT, skipping the test when it is not set. The
+tests only touch keys of their own users so they can be ran against a shared redis.
+*/
+func redisTestPool(t *testing.T) {
+	if os.Getenv("REDIS_PORT") == "" {
+		t.Skip("REDIS_PORT is not set")
+	}
+	purl, err := url.Parse(os.Getenv("REDIS_PORT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := pool.NewPool(purl.Scheme, purl.Host, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := rpool
+	rpool = p
+	t.Cleanup(func() {
+		p.Empty()
+		rpool = prev
+	})
+}
+
+//redisCmd runs a command on rpool for the test.
+func redisCmd(t *testing.T, cmd string, args ...interface{}) *redis.Reply {
+	c, err := rpool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpool.Put(c)
+	rep := c.Cmd(cmd, args...)
+	if rep.Err != nil {
+		t.Fatal(rep.Err)
+	}
+	return rep
+}
+
+//testUserPrefix returns a prefix for the usernames of a test unique to the run.
+func testUserPrefix(t *testing.T) string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "test-" + id.String()[:8] + "-"
+}
+
+/*
+cleanupRedisUsers removes the tokens and counts of sessions of the users with the prefix once the
+test ends.
+*/
+func cleanupRedisUsers(t *testing.T, s *RedisSessionStore, prefix string) {
+	t.Cleanup(func() {
+		tokens, err := s.List()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, token := range tokens {
+			if strings.HasPrefix(token.User, prefix) {
+				s.Expire(token)
+			}
+		}
+		keys, err := redisCmd(t, "KEYS", sessionCountKey(prefix)+"*").List()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, key := range keys {
+			redisCmd(t, "DEL", key)
+		}
+	})
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	redisTestPool(t)
+	s := &RedisSessionStore{}
+	runSessionStoreTests(t, func(t *testing.T) *sessionStoreTest {
+		prefix := testUserPrefix(t)
+		cleanupRedisUsers(t, s, prefix)
+		return &sessionStoreTest{
+			store:  s,
+			prefix: prefix,
+			setCount: func(t *testing.T, username string, count int, expiration time.Time) {
+				redisCmd(t, "HMSET", sessionCountKey(username), "Count", count,
+					"Expiration", expiration.Format(time.RFC3339))
+			},
+			countExpiration: func(t *testing.T, username string) time.Time {
+				exp, err := time.Parse(time.RFC3339, redisCmd(t, "HGET", sessionCountKey(username), "Expiration").String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return exp
+			},
+		}
+	})
+}
+
+/*
+TestRedisSessionStoreRetry runs redisCompleteTaskScript with the expiration of the count of sessions
+as it was before another session counted itself, and checks the session is not counted against the
+stale count and CompleteTask tries again.
+*/
+func TestRedisSessionStoreRetry(t *testing.T) {
+	redisTestPool(t)
+	setTokenExpiration(t, time.Hour)
+	s := &RedisSessionStore{}
+	prefix := testUserPrefix(t)
+	cleanupRedisUsers(t, s, prefix)
+
+	acct := &Account{Username: prefix + "retry", Role: RoleParticipant, Tasks: 4}
+	token, err := s.Create(acct, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The script is given the expiration the count had when it was read, here none
+	next := nextSessionCountReset(time.Now())
+	redisCmd(t, "HMSET", sessionCountKey(acct.Username), "Count", 3, "Expiration", next.Format(time.RFC3339))
+	rep := redisCmd(t, "EVAL", redisCompleteTaskScript, 3, token.ID, sessionCountKey(acct.Username), redisActiveTokens,
+		"Arithmetic", time.Now().Format(time.RFC3339), taskQuota, "", "false", next.Format(time.RFC3339), 60)
+	if n, err := rep.Elems[0].Int64(); err != nil || n != -2 {
+		t.Fatalf("script returned %v %v for a stale count, want -2", n, err)
+	}
+	if count, err := s.SessionCount(acct.Username); err != nil || count != 3 {
+		t.Fatalf("counted %v %v sessions after the stale script, want 3", count, err)
+	}
+
+	//CompleteTask reads the count again and carries it on
+	res, err := s.CompleteTask(token, "Arithmetic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Completed || res.Tasks != 1 {
+		t.Errorf("counted %+v, want the task completed", res)
+	}
+	if count, err := s.SessionCount(acct.Username); err != nil || count != 4 {
+		t.Errorf("counted %v %v sessions, want 4", count, err)
+	}
+}
+
+func TestMigrateRedisSessionCounts(t *testing.T) {
+	redisTestPool(t)
+	s := &RedisSessionStore{}
+	prefix := testUserPrefix(t)
+	cleanupRedisUsers(t, s, prefix)
+
+	//Earlier versions kept the count under the bare username
+	old := prefix + "old"
+	expiration := nextSessionCountReset(time.Now()).Format(time.RFC3339)
+	redisCmd(t, "HMSET", old, "Count", 7, "Expiration", expiration)
+	redisCmd(t, "EXPIRE", old, 3600)
+	t.Cleanup(func() { redisCmd(t, "DEL", old) })
+
+	if err := migrateRedisSessionCounts(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := redisCmd(t, "EXISTS", old).Int64(); err != nil || n != 0 {
+		t.Errorf("the count was left under the bare username")
+	}
+	if count, err := s.SessionCount(old); err != nil || count != 7 {
+		t.Errorf("counted %v %v sessions after the migration, want 7", count, err)
+	}
+	if ttl, err := redisCmd(t, "TTL", sessionCountKey(old)).Int64(); err != nil || ttl <= 0 {
+		t.Errorf("the migrated count expires in %v %v, want its ttl kept", ttl, err)
+	}
+}
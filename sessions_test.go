@@ -0,0 +1,248 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+sessionStoreTest is a SessionStore under test along with the hooks to reach the count of sessions
+of a user, which the SessionStore interface only reads. Usernames are prefixed so the tests do not
+clash with the other users of a shared store.
+*/
+type sessionStoreTest struct {
+	store  SessionStore
+	prefix string
+	//setCount stores the count of sessions of the user as if it was started before.
+	setCount func(t *testing.T, username string, count int, expiration time.Time)
+	//countExpiration returns when the count of sessions of the user is reset.
+	countExpiration func(t *testing.T, username string) time.Time
+}
+
+//account returns a participant account of the store with a quota of tasks.
+func (st *sessionStoreTest) account(name string, tasks int) *Account {
+	return &Account{Username: st.prefix + name, Role: RoleParticipant, Tasks: tasks}
+}
+
+//create starts a session of the account.
+func (st *sessionStoreTest) create(t *testing.T, acct *Account, num int) *AuthToken {
+	token, err := st.store.Create(acct, num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+//sessionCount returns the count of sessions of the account.
+func (st *sessionStoreTest) sessionCount(t *testing.T, acct *Account) int {
+	count, err := st.store.SessionCount(acct.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+/*
+setTokenExpiration sets the lifetime of new tokens for the test, it is otherwise only set from the
+flags.
+*/
+func setTokenExpiration(t *testing.T, d time.Duration) {
+	prev := tokenExpiration
+	tokenExpiration = d
+	t.Cleanup(func() { tokenExpiration = prev })
+}
+
+/*
+sessionStoreTests are ran against every SessionStore. The stores must count the tasks and sessions
+the same way whatever they are kept in.
+*/
+var sessionStoreTests = []struct {
+	name string
+	test func(t *testing.T, st *sessionStoreTest)
+}{
+	{"quota reached", func(t *testing.T, st *sessionStoreTest) {
+		token := st.create(t, st.account("quota", 2), 1)
+		for i, want := range []TaskResult{{Completed: true, Tasks: 1}, {Completed: true, Tasks: 2, Expired: true}} {
+			res, err := st.store.CompleteTask(token, "Task"+strconv.Itoa(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != want {
+				t.Errorf("task %v counted %+v, want %+v", i, res, want)
+			}
+		}
+		if _, err := st.store.Get(token.ID); err != errNoToken {
+			t.Errorf("got %v for the token after its quota, want errNoToken", err)
+		}
+		if _, err := st.store.CompleteTask(token, "Task2"); err != errNoToken {
+			t.Errorf("got %v for a task after the quota, want errNoToken", err)
+		}
+	}},
+	{"duplicate task", func(t *testing.T, st *sessionStoreTest) {
+		token := st.create(t, st.account("duplicate", 4), 1)
+		for i, want := range []TaskResult{{Completed: true, Tasks: 1}, {Tasks: 1}, {Tasks: 1}} {
+			res, err := st.store.CompleteTask(token, "Flanker")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != want {
+				t.Errorf("submission %v counted %+v, want %+v", i, res, want)
+			}
+		}
+		if token.Duplicates["Flanker"] != 2 {
+			t.Errorf("counted %v duplicates, want 2", token.Duplicates["Flanker"])
+		}
+		stored, err := st.store.Get(token.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Tasks != 1 || stored.Duplicates["Flanker"] != 2 {
+			t.Errorf("stored %v tasks and %v duplicates, want 1 and 2", stored.Tasks, stored.Duplicates["Flanker"])
+		}
+		if count := st.sessionCount(t, st.account("duplicate", 4)); count != 1 {
+			t.Errorf("counted %v sessions, want 1", count)
+		}
+	}},
+	{"session count", func(t *testing.T, st *sessionStoreTest) {
+		acct := st.account("count", 4)
+		st.create(t, acct, 1)
+		if count := st.sessionCount(t, acct); count != 0 {
+			t.Errorf("counted %v sessions before a task was completed, want 0", count)
+		}
+		for num := 1; num <= 2; num++ {
+			token := st.create(t, acct, num)
+			for _, task := range []string{"Arithmetic", "Flanker"} {
+				if _, err := st.store.CompleteTask(token, task); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if count := st.sessionCount(t, acct); count != num {
+				t.Errorf("counted %v sessions, want %v", count, num)
+			}
+		}
+	}},
+	{"count reset", func(t *testing.T, st *sessionStoreTest) {
+		acct := st.account("reset", 4)
+		st.setCount(t, acct.Username, 5, time.Now().Add(-time.Hour))
+		if count := st.sessionCount(t, acct); count != 0 {
+			t.Errorf("counted %v sessions after the reset, want 0", count)
+		}
+		token := st.create(t, acct, 6)
+		if _, err := st.store.CompleteTask(token, "Arithmetic"); err != nil {
+			t.Fatal(err)
+		}
+		if count := st.sessionCount(t, acct); count != 1 {
+			t.Errorf("counted %v sessions after the reset, want 1", count)
+		}
+		want := nextSessionCountReset(time.Now()).Format("2006-01-02")
+		if exp := st.countExpiration(t, acct.Username).Format("2006-01-02"); exp != want {
+			t.Errorf("count is reset on %v, want %v", exp, want)
+		}
+
+		//A count that has not been reset carries on until the same day
+		acct = st.account("noreset", 4)
+		expiration := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+		st.setCount(t, acct.Username, 5, expiration)
+		token = st.create(t, acct, 6)
+		if _, err := st.store.CompleteTask(token, "Arithmetic"); err != nil {
+			t.Fatal(err)
+		}
+		if count := st.sessionCount(t, acct); count != 6 {
+			t.Errorf("counted %v sessions, want 6", count)
+		}
+		if exp := st.countExpiration(t, acct.Username); !exp.Equal(expiration) {
+			t.Errorf("count is reset at %v, want %v", exp, expiration)
+		}
+	}},
+	{"concurrent tasks", func(t *testing.T, st *sessionStoreTest) {
+		token := st.create(t, st.account("concurrent", 4), 1)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var completed, expired int
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(task string) {
+				defer wg.Done()
+				//Each request works on its own copy of the token
+				own, err := st.store.Get(token.ID)
+				if err == errNoToken {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				res, err := st.store.CompleteTask(own, task)
+				if err == errNoToken {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if res.Completed {
+					completed++
+				}
+				if res.Expired {
+					expired++
+				}
+			}("Task" + strconv.Itoa(i%4))
+		}
+		wg.Wait()
+		if completed != 4 || expired != 1 {
+			t.Errorf("completed %v tasks and expired %v times, want 4 and 1", completed, expired)
+		}
+		if count := st.sessionCount(t, st.account("concurrent", 4)); count != 1 {
+			t.Errorf("counted %v sessions, want 1", count)
+		}
+	}},
+	{"concurrent sessions", func(t *testing.T, st *sessionStoreTest) {
+		acct := st.account("sessions", 4)
+		var wg sync.WaitGroup
+		for num := 1; num <= 8; num++ {
+			token := st.create(t, acct, num)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := st.store.CompleteTask(token, "Arithmetic"); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if count := st.sessionCount(t, acct); count != 8 {
+			t.Errorf("counted %v sessions, want 8", count)
+		}
+	}},
+}
+
+//runSessionStoreTests runs sessionStoreTests against the store returned by newStore for each test.
+func runSessionStoreTests(t *testing.T, newStore func(t *testing.T) *sessionStoreTest) {
+	setTokenExpiration(t, time.Hour)
+	for _, test := range sessionStoreTests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newStore(t))
+		})
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	runSessionStoreTests(t, func(t *testing.T) *sessionStoreTest {
+		s := NewMemorySessionStore()
+		return &sessionStoreTest{
+			store: s,
+			setCount: func(t *testing.T, username string, count int, expiration time.Time) {
+				s.mu.Lock()
+				s.counts[username] = memorySessionCount{Count: count, Expiration: expiration}
+				s.mu.Unlock()
+			},
+			countExpiration: func(t *testing.T, username string) time.Time {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return s.counts[username].Expiration
+			},
+		}
+	})
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"strconv"
+	"sort"
 	"time"
 
-	"github.com/fzzy/radix/redis"
 	"github.com/nu7hatch/gouuid"
 )
 
@@ -12,174 +11,202 @@ import (
 type AuthToken struct {
 	ID         string
 	User       string
+	Role       Role
+	Demo       bool
 	Expiration time.Time
-	Tasks      int
-	Num        int
+	Created    time.Time
+	//SessionTime names the results files of the session, it is kept when the session is resumed.
+	SessionTime time.Time
+	Tasks       int
+	//TaskQuota is the number of tasks the session ends after, unlimitedTasks for no limit.
+	TaskQuota int
+	Num       int
+	//Completed holds when each task of the session was completed by the Task name of its results.
+	Completed map[string]time.Time
+	//Duplicates counts the results of completed tasks that were submitted again.
+	Duplicates map[string]int
+	//Resumed counts the times the session was resumed after it was interrupted.
+	Resumed int
+	//LastActivity is when the session was started, last completed a task or was resumed.
+	LastActivity time.Time
+}
+
+//TaskResult is what CompleteTask counted, read from the SessionStore rather than the token.
+type TaskResult struct {
+	//Completed is false for the results of a task that was already completed in the session.
+	Completed bool
+	//Tasks is the number of tasks completed in the session.
+	Tasks int
+	//Expired is true when the task completed the quota of the session and the token was expired.
+	Expired bool
+}
+
+//CompletedTask is a task completed in a session.
+type CompletedTask struct {
+	Task string
+	Time time.Time
 }
 
 /*
-GetAuthToken fetchs a token from the database using the provided id
+SessionStore is implemented by the backends that sessions can be kept in. Besides the AuthTokens it
+keeps the short lived values of the login lockouts and two-factor logins, which expire after their
+ttl. Get returns errNoToken for a token that does not exist or has expired.
 */
-func GetAuthToken(token string) (*AuthToken, error) {
-	var auth AuthToken
-	c, err := rpool.Get()
-	if err != nil {
-		return nil, err
-	}
-	defer rpool.CarefullyPut(c, &err)
+type SessionStore interface {
+	Get(id string) (*AuthToken, error)
+	//Create creates the token of the session num of the account.
+	Create(acct *Account, num int) (*AuthToken, error)
+	//SessionCount returns the number of sessions of the user within sessCountMonths.
+	SessionCount(username string) (int, error)
+	//CompleteTask records that the task was completed and counts it against the token, expiring it
+	//once its quota is reached. A task that was already completed is counted as a duplicate instead.
+	//The counting is atomic so concurrent results are each counted once.
+	CompleteTask(token *AuthToken, task string) (TaskResult, error)
+	Expire(token *AuthToken) error
+	//Extend moves the expiration of the token, returning errNoToken if it has already expired.
+	Extend(token *AuthToken, expiration time.Time) error
+	//Resume saves the session state copied into a token that has not completed any tasks, returning
+	//errNoToken if it has already expired and errSessionStarted if the stored token has completed a
+	//task. The check is atomic with the save so a task completed at the same time is not lost.
+	Resume(token *AuthToken) error
+	//List returns the tokens that have not expired.
+	List() ([]*AuthToken, error)
+
+	SetValue(key, value string, ttl time.Duration) error
+	//SetValueNX only sets the value if the key does not exist and returns whether it did.
+	SetValueNX(key, value string, ttl time.Duration) (bool, error)
+	//GetValue returns false if the key does not exist.
+	GetValue(key string) (string, bool, error)
+	//TTL returns the time left before the key expires, zero if it does not exist.
+	TTL(key string) (time.Duration, error)
+	//Incr increments the counter at key and sets it to expire after ttl.
+	Incr(key string, ttl time.Duration) (int64, error)
+	DeleteValues(keys ...string) error
+}
 
-	rep := c.Cmd("HGETALL", token)
-	if rep.Err != nil {
-		return nil, rep.Err
-	} else if rep.Type == redis.NilReply {
-		return nil, errNoToken
-	}
-	var vals map[string]string
-	vals, err = rep.Hash()
-	if err != nil {
-		return nil, err
-	}
-	auth.User = vals["User"]
-	auth.Expiration, err = time.Parse(time.RFC3339, vals["Expiration"])
-	if err != nil {
-		return nil, err
-	}
-	var temp int64
-	temp, err = strconv.ParseInt(vals["Tasks"], 10, 32)
+/*
+newAuthToken fills in a new AuthToken for the session num of the account.
+*/
+func newAuthToken(acct *Account, num int) (*AuthToken, error) {
+	id, err := uuid.NewV4()
 	if err != nil {
 		return nil, err
 	}
-	auth.Tasks = int(temp)
+	//The stores keep the times to the second
+	now := time.Now().Truncate(time.Second)
+	return &AuthToken{
+		ID:           id.String(),
+		User:         acct.Username,
+		Role:         acct.Role,
+		Demo:         acct.Demo,
+		Expiration:   now.Add(tokenExpiration),
+		Created:      now,
+		SessionTime:  now.Add(tokenExpiration),
+		TaskQuota:    acct.TaskQuota(),
+		Num:          num,
+		Completed:    make(map[string]time.Time),
+		Duplicates:   make(map[string]int),
+		LastActivity: now,
+	}, nil
+}
 
-	temp, err = strconv.ParseInt(vals["Num"], 10, 32)
-	if err != nil {
-		return nil, err
+/*
+MaxExpiration returns the time the token expires at however long the participant extends it for.
+An admin can extend it past that, in which case it is the current expiration.
+*/
+func (t *AuthToken) MaxExpiration() time.Time {
+	max := t.Created.Add(tokenMaxLifetime)
+	if t.Expiration.After(max) {
+		return t.Expiration
 	}
-	auth.Num = int(temp)
-	auth.ID = token
+	return max
+}
 
-	return &auth, nil
+/*
+Participant reports whether the token is the session of a participant rather than of a demo account
+or of lab staff, which are run through the tasks without taking part in the study.
+*/
+func (t *AuthToken) Participant() bool {
+	return t.Role == RoleParticipant && !t.Demo
 }
 
 /*
-NewAuthToken creates a new AuthToken triggering a new session
+QuotaReached reports whether the session has completed all the tasks of its quota.
 */
-func NewAuthToken(username string) (*AuthToken, error) {
-	id, err := uuid.NewV4()
-	if err != nil {
-		return nil, err
-	}
-	token := &AuthToken{}
-	token.ID = id.String()
-	token.User = username
-	token.Expiration = time.Now().Add(tokenExpiration)
-	token.Num = 1
+func (t *AuthToken) QuotaReached() bool {
+	return t.TaskQuota != unlimitedTasks && t.Tasks >= t.TaskQuota
+}
 
-	c, err := rpool.Get()
-	if err != nil {
-		return nil, err
-	}
-	defer rpool.CarefullyPut(c, &err)
-
-	res := c.Cmd("HMGET", token.User, "Count", "Expiration")
-	if res.Err != nil {
-		return nil, res.Err
-	} else if res.Type != redis.NilReply {
-		vals, err := res.List()
-		if err != nil {
-			return nil, err
-		}
-		if vals[0] != "" && vals[1] != "" {
-			exp, err := time.Parse(time.RFC3339, vals[1])
-			if err != nil {
-				return nil, err
-			}
-			if exp.After(time.Now()) {
-				num, err := strconv.ParseInt(vals[0], 10, 32)
-				if err != nil {
-					return nil, err
-				}
-				token.Num += int(num)
-			}
-		}
-	}
-	c.Append("HMSET", token.ID,
-		"User", username,
-		"Expiration", token.Expiration.Format(time.RFC3339),
-		"Tasks", token.Tasks,
-		"Num", token.Num)
-	c.Append("EXPIRE", token.ID, int64(tokenExpiration.Seconds()))
-
-	if err = c.GetReply().Err; err != nil {
-		return nil, err
-	}
-	if err = c.GetReply().Err; err != nil {
-		return nil, err
+/*
+TasksRemaining returns the number of tasks left in the quota of the session.
+*/
+func (t *AuthToken) TasksRemaining() int {
+	if t.Tasks >= t.TaskQuota {
+		return 0
 	}
+	return t.TaskQuota - t.Tasks
+}
 
-	return token, nil
+/*
+CompletedTasks returns the tasks completed in the session in the order they were completed.
+*/
+func (t *AuthToken) CompletedTasks() []CompletedTask {
+	tasks := make([]CompletedTask, 0, len(t.Completed))
+	for task, at := range t.Completed {
+		tasks = append(tasks, CompletedTask{Task: task, Time: at})
+	}
+	sort.Sort(completedByTime(tasks))
+	return tasks
 }
 
-func IncrementTasks(token *AuthToken) error {
+//completedByTime sorts completed tasks by when they were completed, then by name.
+type completedByTime []CompletedTask
 
-	c, err := rpool.Get()
-	if err != nil {
-		return err
-	}
-	defer rpool.CarefullyPut(c, &err)
-	count := 0
-	if token.Tasks == 0 {
-		now := time.Now()
-		next := now.AddDate(0, sessCountMonths, -1*now.Day()+1)
-		res := c.Cmd("HGET", token.User, "Expiration")
-		if res.Err != nil {
-			return err
-		} else if res.Type != redis.NilReply {
-			exp, err := time.Parse(time.RFC3339, res.String())
-			if err != nil {
-				return err
-			}
-			if exp.After(now) {
-				c.Append("HINCRBY", token.User, "Count", 1)
-				c.Append("EXPIRE", token.User, int64(next.Sub(now).Seconds()))
-				count += 2
-			} else {
-				c.Append("HMSET", token.User, "Count", 1, "Expiration", next.Format(time.RFC3339))
-				c.Append("EXPIRE", token.User, int64(next.Sub(now).Seconds()))
-				count += 2
-			}
-		} else {
-			c.Append("HMSET", token.User, "Count", 1, "Expiration", next.Format(time.RFC3339))
-			c.Append("EXPIRE", token.User, int64(next.Sub(now).Seconds()))
-			count += 2
-		}
+func (s completedByTime) Len() int      { return len(s) }
+func (s completedByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s completedByTime) Less(i, j int) bool {
+	if s[i].Time.Equal(s[j].Time) {
+		return s[i].Task < s[j].Task
 	}
-	token.Tasks++
-
-	c.Append("HINCRBY", token.ID, "Tasks", 1)
-	c.Append("EXPIRE", token.ID, int64(token.Expiration.Sub(time.Now()).Seconds()))
-	count += 2
-	for count > 0 {
-		if err = c.GetReply().Err; err != nil {
-			return err
+	return s[i].Time.Before(s[j].Time)
+}
+
+/*
+PendingTasks returns the tasks of the battery, in the order of taskNames, that have not been
+completed in the session.
+*/
+func (t *AuthToken) PendingTasks() []string {
+	pending := make([]string, 0, len(taskNames))
+	for _, task := range taskNames {
+		if _, done := t.Completed[task]; !done {
+			pending = append(pending, task)
 		}
-		count--
 	}
-	return nil
+	return pending
 }
 
 /*
-ExpireToken expires the token by setting the expiration to now -1 second
+extendToken moves the expiration of the token to tokenExpiration from now, but never past its
+MaxExpiration. It returns whether the expiration was moved.
 */
-func ExpireToken(token *AuthToken) error {
-	c, err := rpool.Get()
-	if err != nil {
-		return err
+func extendToken(token *AuthToken) (bool, error) {
+	expiration := time.Now().Add(tokenExpiration).Truncate(time.Second)
+	if max := token.MaxExpiration(); expiration.After(max) {
+		expiration = max
 	}
-	defer rpool.CarefullyPut(c, &err)
-
-	if err = c.Cmd("DEL", token.ID).Err; err != nil {
-		return err
+	if !expiration.After(token.Expiration) {
+		return false, nil
 	}
-	return nil
+	if err := sessions.Extend(token, expiration); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+nextSessionCountReset returns when the count of sessions of a user started now is reset, the
+start of the month sessCountMonths from now.
+*/
+func nextSessionCountReset(now time.Time) time.Time {
+	return now.AddDate(0, sessCountMonths, -1*now.Day()+1)
 }
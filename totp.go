@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/nu7hatch/gouuid"
+)
+
+/*
+Two-factor authentication uses RFC 6238 time based one time passwords with the defaults every
+authenticator app supports: HMAC-SHA1, 6 digits and a 30 second period. A code from the period
+before or after the current one is also accepted to allow for clock drift.
+*/
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpIssuer = "Activebrain"
+
+	//totpChallengeCookie holds the signed id of the login waiting for its second step.
+	totpChallengeCookie = "X-TOTP-Challenge"
+	totpChallengeExpiry = 5 * time.Minute
+	//totpSetupExpiry is how long a new secret waits to be confirmed with a code.
+	totpSetupExpiry = 10 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+/*
+TOTPCodeRequest is the structure used to receive a code from an authenticator app or a recovery
+code.
+*/
+type TOTPCodeRequest struct {
+	Code string `form:"Code" json:"Code" binding:"required"`
+}
+
+/*
+TOTPLoginRequest is the structure used to receive the second step of a token login.
+*/
+type TOTPLoginRequest struct {
+	TOTPToken string `json:"TOTPToken" binding:"required"`
+	Code      string `json:"Code" binding:"required"`
+}
+
+/*
+newTOTPSecret generates a random 160 bit secret encoded as base32 without padding, the form
+authenticator apps expect.
+*/
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+/*
+totpCode calculates the code of the secret for a time step as described in RFC 4226.
+*/
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+/*
+checkTOTPCode returns the time step the code belongs to if it is valid for the secret at now.
+*/
+func checkTOTPCode(secret, code string, now time.Time) (uint64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	counter := uint64(now.Unix() / totpPeriod)
+	for _, step := range []uint64{counter, counter - 1, counter + 1} {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+/*
+totpURI returns the otpauth URI that authenticator apps read from a QR code.
+*/
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+/*
+useTOTPStep marks the time step as used for the username so the same code cannot be used twice. It
+returns false if the step was already used.
+*/
+func useTOTPStep(username string, step uint64) (bool, error) {
+	key := "totp:used:" + username + ":" + strconv.FormatUint(step, 10)
+	return sessions.SetValueNX(key, "1", 3*totpPeriod*time.Second)
+}
+
+/*
+newRecoveryCodes generates the recovery codes shown to the user and the hashes stored with the
+account. The codes are random enough that a fast hash is sufficient.
+*/
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := enc.EncodeToString(b)
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+/*
+hashRecoveryCode hashes a recovery code ignoring case, spaces and dashes.
+*/
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+verifySecondFactor checks a code from the authenticator app or one of the recovery codes of the
+account. A recovery code is removed from the account once used. errInvalidCredentials is returned
+for a wrong or reused code.
+*/
+func verifySecondFactor(acct *Account, code string) error {
+	code = strings.TrimSpace(code)
+	if step, ok := checkTOTPCode(acct.TOTPSecret, code, time.Now()); ok {
+		if fresh, err := useTOTPStep(acct.Username, step); err != nil {
+			return err
+		} else if !fresh {
+			return errInvalidCredentials
+		}
+		return nil
+	}
+
+	hash := hashRecoveryCode(code)
+	return accounts.Update(acct.Username, func(a *Account) error {
+		for i, h := range a.RecoveryCodes {
+			if hmac.Equal([]byte(h), []byte(hash)) {
+				a.RecoveryCodes = append(a.RecoveryCodes[:i:i], a.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return errInvalidCredentials
+	})
+}
+
+/*
+newTOTPChallenge remembers that the username has passed the password step of a login and returns
+the id of the challenge to finish it with.
+*/
+func newTOTPChallenge(username string) (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	err = sessions.SetValue("totp:challenge:"+id.String(), username, totpChallengeExpiry)
+	return id.String(), err
+}
+
+/*
+takeTOTPChallenge returns the username of a challenge. The challenge is only removed when remove is
+true so a mistyped code can be tried again. errInvalidChallenge is returned for unknown or expired
+challenges.
+*/
+func takeTOTPChallenge(id string, remove bool) (string, error) {
+	key := "totp:challenge:" + id
+	username, ok, err := sessions.GetValue(key)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", errInvalidChallenge
+	}
+	if remove {
+		if err = sessions.DeleteValues(key); err != nil {
+			return "", err
+		}
+	}
+	return username, nil
+}
+
+/*
+startTOTPLogin starts the second step of a login from the login form.
+*/
+func startTOTPLogin(c *gin.Context, acct *Account) {
+	id, err := newTOTPChallenge(acct.Username)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     totpChallengeCookie,
+		Value:    cookieSigner.Sign(id),
+		Path:     "/login",
+		MaxAge:   int(totpChallengeExpiry.Seconds()),
+		HttpOnly: true,
+		Secure:   httpsAddr != "",
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Redirect(303, "/login/totp")
+}
+
+/*
+finishTOTPLogin checks the code for the challenge and starts the session. The same lockouts as the
+password step apply.
+*/
+func finishTOTPLogin(c *gin.Context, id, code string) (*AuthToken, time.Duration, error) {
+	username, err := takeTOTPChallenge(id, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := c.ClientIP()
+	if wait, err := loginLockout(username, ip); err != nil {
+		return nil, 0, err
+	} else if wait > 0 {
+		audit(c, auditLoginFailed, username, "", "locked out")
+		return nil, wait, errLockedOut
+	}
+
+	acct, err := accounts.Get(username)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = acct.CheckAccess(time.Now()); err != nil {
+		audit(c, auditLoginFailed, username, "", err.Error())
+		return nil, 0, err
+	}
+	if err = verifySecondFactor(acct, code); err == errInvalidCredentials {
+		audit(c, auditLoginFailed, username, "", "invalid two-factor code")
+		wait, err := recordLoginFailure(username, ip)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, wait, errInvalidCredentials
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err = takeTOTPChallenge(id, true); err != nil {
+		return nil, 0, err
+	}
+	token, err := startSession(c, acct, "password+totp")
+	return token, 0, err
+}
+
+/*
+getLoginTOTP shows the form asking for the two-factor code.
+*/
+func getLoginTOTP(c *gin.Context) {
+	props := gin.H{
+		"csrf": c.MustGet("csrf"),
+	}
+	if c.Query("retry") != "" {
+		props["message"] = "That code is not valid, please try again."
+	}
+	c.HTML(200, "totp.tmpl", props)
+}
+
+/*
+postLoginTOTP handles the two-factor code from the login form.
+*/
+func postLoginTOTP(c *gin.Context) {
+	var req TOTPCodeRequest
+	if err := binding.Form.Bind(c.Request, &req); err != nil {
+		c.Redirect(303, "/login/totp?retry=1")
+		return
+	}
+	var id string
+	cookie, err := c.Request.Cookie(totpChallengeCookie)
+	if err == nil {
+		id, _, err = cookieSigner.Verify(cookie.Value)
+	}
+	if err != nil {
+		c.Redirect(303, "/login")
+		return
+	}
+
+	token, wait, err := finishTOTPLogin(c, id, req.Code)
+	if reason, ok := accessReasons[err]; ok {
+		c.Redirect(303, "/login?access="+reason)
+		return
+	} else if wait > 0 {
+		redirectLocked(c, wait)
+		return
+	} else if err == errInvalidCredentials {
+		c.Redirect(303, "/login/totp?retry=1")
+		return
+	} else if err == errInvalidChallenge {
+		c.Redirect(303, "/login")
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{Name: totpChallengeCookie, Path: "/login", MaxAge: -1})
+	setAuthCookie(c, token)
+	c.Redirect(303, "/")
+}
+
+/*
+postLoginTokenTOTP is the second step of a token login for accounts with two-factor
+authentication.
+*/
+func postLoginTokenTOTP(c *gin.Context) {
+	var req TOTPLoginRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	id, _, err := cookieSigner.Verify(req.TOTPToken)
+	if err != nil {
+		c.JSON(401, gin.H{"error": errInvalidChallenge.Error()})
+		return
+	}
+
+	token, wait, err := finishTOTPLogin(c, id, req.Code)
+	if _, ok := accessReasons[err]; ok {
+		c.JSON(403, gin.H{"error": err.Error()})
+		return
+	} else if wait > 0 {
+		lockedOut(c, wait)
+		return
+	} else if err == errInvalidCredentials {
+		c.JSON(401, gin.H{"error": "invalid two-factor code"})
+		return
+	} else if err == errInvalidChallenge {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	tokenResponse(c, token)
+}
+
+/*
+postTOTPSetup starts enabling two-factor authentication for the logged in account. The secret is
+returned once, with the otpauth URI to show as a QR code, and must be confirmed with a code before
+it is used.
+*/
+func postTOTPSetup(c *gin.Context) {
+	token := c.MustGet("token").(*AuthToken)
+	acct, err := accounts.Get(token.User)
+	if err == errAccountNotFound {
+		c.JSON(404, gin.H{"error": "two-factor authentication is only available for local accounts"})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if acct.TOTPSecret != "" {
+		c.JSON(409, gin.H{"error": errTOTPEnabled.Error()})
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if err = sessions.SetValue("totp:setup:"+acct.Username, secret, totpSetupExpiry); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Secret": secret,
+		"URI":    totpURI(acct.Username, secret),
+	})
+}
+
+/*
+postTOTPConfirm enables two-factor authentication once a code from the new secret is sent. The
+recovery codes are returned once, only their hashes are kept.
+*/
+func postTOTPConfirm(c *gin.Context) {
+	var req TOTPCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	token := c.MustGet("token").(*AuthToken)
+
+	secret, ok, err := sessions.GetValue("totp:setup:" + token.User)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	} else if !ok {
+		c.JSON(400, gin.H{"error": "no two-factor setup in progress, start again"})
+		return
+	}
+
+	if _, ok := checkTOTPCode(secret, strings.TrimSpace(req.Code), time.Now()); !ok {
+		c.JSON(400, gin.H{"error": "invalid code"})
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	err = accounts.Update(token.User, func(a *Account) error {
+		if a.TOTPSecret != "" {
+			return errTOTPEnabled
+		}
+		a.TOTPSecret = secret
+		a.RecoveryCodes = hashes
+		return nil
+	})
+	if err == errTOTPEnabled {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	} else if !accountsUpdateError(c, err) {
+		return
+	}
+	if err = sessions.DeleteValues("totp:setup:" + token.User); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	audit(c, auditTOTP, token.User, token.ID, "enabled")
+	c.JSON(200, gin.H{"RecoveryCodes": codes})
+}
+
+/*
+deleteTOTP turns off two-factor authentication for the logged in account, which needs a current
+code or recovery code.
+*/
+func deleteTOTP(c *gin.Context) {
+	var req TOTPCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	token := c.MustGet("token").(*AuthToken)
+	acct, err := accounts.Get(token.User)
+	if !accountsUpdateError(c, err) {
+		return
+	}
+	if acct.TOTPSecret == "" {
+		c.JSON(400, gin.H{"error": "two-factor authentication is not enabled"})
+		return
+	}
+	if err = verifySecondFactor(acct, req.Code); err == errInvalidCredentials {
+		c.JSON(400, gin.H{"error": "invalid code"})
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if !accountsUpdateError(c, clearTOTP(token.User)) {
+		return
+	}
+	audit(c, auditTOTP, token.User, token.ID, "disabled")
+	c.Status(204)
+}
+
+/*
+deleteAccountTOTP lets an admin turn off two-factor authentication for an account that lost its
+authenticator and recovery codes.
+*/
+func deleteAccountTOTP(c *gin.Context) {
+	if !accountsUpdateError(c, clearTOTP(c.Param("username"))) {
+		return
+	}
+	c.Status(204)
+}
+
+func clearTOTP(username string) error {
+	return accounts.Update(username, func(a *Account) error {
+		a.TOTPSecret = ""
+		a.RecoveryCodes = nil
+		return nil
+	})
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+/*
+watchFile uses inotify to watch the folder containing path and signals on the returned channel
+whenever the file is written, replaced or removed. The folder is watched rather than the file so
+editors and the admin API that replace the file with a rename are picked up.
+*/
+func watchFile(path string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_DELETE)
+	if _, err = syscall.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	name := []byte(filepath.Base(path))
+	changed := make(chan struct{}, 1)
+
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			} else if err != nil {
+				log.Printf("stopped watching accounts file, %v", err)
+				return
+			}
+
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				start := off + syscall.SizeofInotifyEvent
+				off = start + int(event.Len)
+				if !bytes.Equal(bytes.TrimRight(buf[start:off], "\x00"), name) {
+					continue
+				}
+				select {
+				case changed <- struct{}{}:
+				default: //A reload is already pending
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+/*
+watchFile is not supported on this platform, the accounts file is only checked on the
+checkAccount interval.
+*/
+func watchFile(path string) (<-chan struct{}, error) {
+	return nil, nil
+}
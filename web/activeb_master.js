@@ -1,22 +1,12 @@
 // Generated by CoffeeScript 1.7.1
 (function() {
-  var getOrder, getSession, getSubject, _;
+  var checkExpiry, expiryWarning, getSession, getSubject, logout, resumeSession, taskNames, warnExpiry, watchExpiry, _,
+    __indexOf = [].indexOf || function(item) { for (var i = 0, l = this.length; i < l; i++) { if (i in this && this[i] === item) return i; } return -1; };
 
   _ = Psy._;
 
   this.Active_Brain = {};
 
-  window.orderSet = {
-    1: [[1, 2, 3, 4], [2, 1, 4, 3], [3, 4, 1, 2], [4, 3, 2, 1]],
-    2: [[2, 1, 4, 3], [3, 4, 1, 2], [4, 3, 2, 1], [1, 2, 3, 4]],
-    3: [[3, 4, 1, 2], [4, 3, 2, 1], [1, 2, 3, 4], [2, 1, 4, 3]],
-    4: [[4, 3, 2, 1], [1, 2, 3, 4], [2, 1, 4, 3], [3, 4, 1, 2]]
-  };
-
-  getOrder = function(index) {
-    return window.orderSet[(index + 1).toString()];
-  };
-
   getSession = function() {
     return $.getJSON("/session");
   };
@@ -25,22 +15,57 @@
     return $.getJSON("/subject");
   };
 
+  expiryWarning = 300;
+
+  watchExpiry = function(remaining) {
+    clearTimeout(window._expiryTimer);
+    return window._expiryTimer = setTimeout(checkExpiry, Math.max(remaining - expiryWarning, 0) * 1000);
+  };
+
+  checkExpiry = function() {
+    return getSession().then(function(session) {
+      $("#expiry-warning").remove();
+      if (session.data.Remaining > expiryWarning) {
+        return watchExpiry(session.data.Remaining);
+      } else {
+        return warnExpiry(session.data);
+      }
+    });
+  };
+
+  warnExpiry = function(session) {
+    var minutes;
+    minutes = Math.ceil(session.Remaining / 60);
+    $("body").prepend('<div id="expiry-warning" style="background:#fc0;text-align:center;padding:4px">Your session ends in about ' + minutes + ' minute(s). </div>');
+    if (session.SlidingExpiry && session.Expiration !== session.MaxExpiration) {
+      $('<button>Continue</button>').appendTo("#expiry-warning").click(function() {
+        return $.ajax({
+          type: "POST",
+          url: "/session/refresh"
+        }).then(checkExpiry);
+      });
+    }
+    if (session.Remaining > 0) {
+      clearTimeout(window._expiryTimer);
+      return window._expiryTimer = setTimeout(checkExpiry, 60000);
+    }
+  };
+
+  logout = function() {
+    if (confirm("Log out? The task you are on will not be saved.")) {
+      return $.ajax({
+        type: "POST",
+        url: "/logout"
+      }).always(function() {
+        return window.location = "/login";
+      });
+    }
+  };
+
   Active_Brain.teststart = (function(_this) {
     return function() {
-      var ind, order, session, subject, taskSet, tasks;
-      subject = 100;
-      session = 4;
-      tasks = [AST, ArrowFlanker, TrailsB, RAT];
-      order = getOrder(subject % 4)[session - 1];
-      taskSet = (function() {
-        var _i, _len, _results;
-        _results = [];
-        for (_i = 0, _len = order.length; _i < _len; _i++) {
-          ind = order[_i];
-          _results.push(tasks[ind - 1]);
-        }
-        return _results;
-      })();
+      var taskSet;
+      taskSet = [AST, ArrowFlanker, TrailsB, RAT];
       return Start.start(1, 1).then(function() {
         return taskSet[0].start(1, 1);
       }).then(function() {
@@ -55,35 +80,83 @@
     };
   })(this);
 
+  taskNames = ["Arithmetic", "Flanker", "TrailsA", "Remote Associates"];
+
+  resumeSession = function(session) {
+    var resumable;
+    resumable = session.data.Resumable;
+    if ((resumable != null) && confirm("You have an unfinished session " + resumable.ID + " with " + resumable.Tasks + " task(s) completed. Continue where you left off?")) {
+      return $.ajax({
+        type: "POST",
+        url: "/session/resume",
+        headers: {
+          "X-CSRF-Token": session.data.CSRFToken
+        }
+      }).then(function() {
+        return getSession();
+      });
+    } else {
+      return session;
+    }
+  };
+
   Active_Brain.start = (function(_this) {
-    return function(subject, session) {
-      var ind, order, orderIndex, tasks;
-      orderIndex = subject % 4;
+    return function() {
+      var tasks;
       tasks = [AST, ArrowFlanker, TrailsB, RAT];
-      order = getOrder(orderIndex)[session - 1];
-      window.taskSet = (function() {
-        var _i, _len, _results;
-        _results = [];
-        for (_i = 0, _len = order.length; _i < _len; _i++) {
-          ind = order[_i];
-          _results.push(tasks[ind - 1]);
-        }
-        return _results;
-      })();
-      return getSession().then(function(session) {
+      return getSession().then(resumeSession).then(function(session) {
+        var done, name, t;
         window._session = Number(session.data.ID);
+        $.ajaxSetup({
+          headers: {
+            "X-CSRF-Token": session.data.CSRFToken
+          }
+        });
+        if (session.data.Demo) {
+          $("body").prepend('<div id="demo-banner" style="background:#fc0;text-align:center;padding:4px">Demo mode, results are not recorded</div>');
+        }
+        watchExpiry(session.data.Remaining);
+        $('<button id="logout" style="position:fixed;top:4px;right:4px">Log out</button>').appendTo("body").click(logout);
+        done = (function() {
+          var _i, _len, _ref, _results;
+          _ref = session.data.CompletedTasks;
+          _results = [];
+          for (_i = 0, _len = _ref.length; _i < _len; _i++) {
+            t = _ref[_i];
+            _results.push(t.Task);
+          }
+          return _results;
+        })();
+        window.taskSet = (function() {
+          var _i, _len, _ref, _results;
+          _ref = session.data.TaskOrder;
+          _results = [];
+          for (_i = 0, _len = _ref.length; _i < _len; _i++) {
+            name = _ref[_i];
+            if (__indexOf.call(taskNames, name) >= 0 && __indexOf.call(done, name) < 0) {
+              _results.push(tasks[taskNames.indexOf(name)]);
+            }
+          }
+          return _results;
+        })();
+        if (session.data.TasksRemaining != null) {
+          window.taskSet = taskSet.slice(0, session.data.TasksRemaining);
+        }
         return getSubject();
       }).then(function(subject) {
+        var run, task, _fn, _i, _len;
         window._subject = subject.data.ID;
-        return Start.start(window._session, window._subject).then(function() {
-          return taskSet[0].start(window._session, window._subject);
-        }).then(function() {
-          return taskSet[1].start(window._session, window._subject);
-        }).then(function() {
-          return taskSet[2].start(window._session, window._subject);
-        }).then(function() {
-          return taskSet[3].start(window._session, window._subject);
-        }).then(function() {
+        run = Start.start(window._session, window._subject);
+        _fn = function(task) {
+          return run = run.then(function() {
+            return task.start(window._session, window._subject);
+          });
+        };
+        for (_i = 0, _len = taskSet.length; _i < _len; _i++) {
+          task = taskSet[_i];
+          _fn(task);
+        }
+        return run.then(function() {
           return Done.start.start(window._session, window._subject);
         });
       });